@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rancher/kontainer-engine/types"
+)
+
+// Backups are configured through the environment, and snapshots are disabled
+// unless the endpoint and the bucket are set:
+//
+//	LKE_DRIVER_BACKUP_ENDPOINT    the host[:port] of the S3-compatible object
+//	                              storage, e.g. us-east-1.linodeobjects.com
+//	LKE_DRIVER_BACKUP_BUCKET      the bucket holding the snapshots
+//	LKE_DRIVER_BACKUP_PREFIX      an optional key prefix within the bucket
+//	LKE_DRIVER_BACKUP_REGION      the region of the bucket, if required
+//	LKE_DRIVER_BACKUP_ACCESS_KEY  the access key of the object storage
+//	LKE_DRIVER_BACKUP_SECRET_KEY  the secret key of the object storage
+//	LKE_DRIVER_BACKUP_INSECURE    true to talk plain HTTP, e.g. to a local MinIO
+const (
+	backupEndpointEnv  = "LKE_DRIVER_BACKUP_ENDPOINT"
+	backupBucketEnv    = "LKE_DRIVER_BACKUP_BUCKET"
+	backupPrefixEnv    = "LKE_DRIVER_BACKUP_PREFIX"
+	backupRegionEnv    = "LKE_DRIVER_BACKUP_REGION"
+	backupAccessKeyEnv = "LKE_DRIVER_BACKUP_ACCESS_KEY"
+	backupSecretKeyEnv = "LKE_DRIVER_BACKUP_SECRET_KEY"
+	backupInsecureEnv  = "LKE_DRIVER_BACKUP_INSECURE"
+
+	snapshotExtension = ".tar.gz"
+	// The size of a snapshot is unknown while it streams, and minio-go would
+	// buffer parts large enough for the largest object otherwise
+	snapshotPartSize = 16 << 20
+)
+
+var errBackupsNotConfigured = errors.New("backups are not configured, set " + backupEndpointEnv + " and " + backupBucketEnv)
+
+func addSnapshotFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["snapshot-retention-count"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "The number of most recent snapshots to keep, 0 keeps all of them",
+	}
+	driverFlag.Options["snapshot-retention-hours"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Delete snapshots older than this many hours, 0 keeps all of them",
+	}
+}
+
+type backupConfig struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+}
+
+// backupConfigFromEnv reads the backup configuration from the environment.
+// It returns nil if backups are not configured.
+func backupConfigFromEnv() (*backupConfig, error) {
+	config := &backupConfig{
+		Endpoint:  os.Getenv(backupEndpointEnv),
+		Bucket:    os.Getenv(backupBucketEnv),
+		Prefix:    os.Getenv(backupPrefixEnv),
+		Region:    os.Getenv(backupRegionEnv),
+		AccessKey: os.Getenv(backupAccessKeyEnv),
+		SecretKey: os.Getenv(backupSecretKeyEnv),
+	}
+	if config.Endpoint == "" && config.Bucket == "" {
+		return nil, nil
+	}
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("both %s and %s must be set to enable backups", backupEndpointEnv, backupBucketEnv)
+	}
+
+	if insecure := os.Getenv(backupInsecureEnv); insecure != "" {
+		var err error
+		if config.Insecure, err = strconv.ParseBool(insecure); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", backupInsecureEnv, err)
+		}
+	}
+	return config, nil
+}
+
+// backupStore keeps the snapshots of the clusters in a bucket, under
+// <prefix>/<cluster id>/<snapshot name>.tar.gz.
+type backupStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newBackupStore(config *backupConfig) (*backupStore, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: !config.Insecure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object storage client for %s: %s", config.Endpoint, err)
+	}
+	return &backupStore{client: client, bucket: config.Bucket, prefix: config.Prefix}, nil
+}
+
+// backupStoreFromEnv returns the store configured by the environment, or nil
+// if backups are not configured.
+func backupStoreFromEnv() (*backupStore, error) {
+	config, err := backupConfigFromEnv()
+	if err != nil || config == nil {
+		return nil, err
+	}
+	return newBackupStore(config)
+}
+
+func (s *backupStore) snapshotKey(clusterID int, snapshotName string) string {
+	return path.Join(s.prefix, strconv.Itoa(clusterID), snapshotName+snapshotExtension)
+}
+
+// put uploads the snapshot, reading it until EOF.
+func (s *backupStore) put(ctx context.Context, clusterID int, snapshotName string, snapshot io.Reader) error {
+	key := s.snapshotKey(clusterID, snapshotName)
+	_, err := s.client.PutObject(ctx, s.bucket, key, snapshot, -1, minio.PutObjectOptions{
+		ContentType: "application/gzip",
+		PartSize:    snapshotPartSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload snapshot %s to bucket %s: %s", key, s.bucket, err)
+	}
+	return nil
+}
+
+// get downloads the snapshot. The caller must close it.
+func (s *backupStore) get(ctx context.Context, clusterID int, snapshotName string) (io.ReadCloser, error) {
+	key := s.snapshotKey(clusterID, snapshotName)
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download snapshot %s from bucket %s: %s", key, s.bucket, err)
+	}
+	// GetObject is lazy, so make sure the snapshot exists
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to download snapshot %s from bucket %s: %s", key, s.bucket, err)
+	}
+	return object, nil
+}
+
+// remove deletes the snapshot. Deleting a snapshot that does not exist is not
+// an error.
+func (s *backupStore) remove(ctx context.Context, clusterID int, snapshotName string) error {
+	key := s.snapshotKey(clusterID, snapshotName)
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s from bucket %s: %s", key, s.bucket, err)
+	}
+	return nil
+}
+
+// snapshotInfo describes a snapshot in the store.
+type snapshotInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// list returns the snapshots of the cluster, newest first.
+func (s *backupStore) list(ctx context.Context, clusterID int) ([]snapshotInfo, error) {
+	prefix := path.Join(s.prefix, strconv.Itoa(clusterID)) + "/"
+
+	snapshots := []snapshotInfo{}
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list snapshots in bucket %s: %s", s.bucket, object.Err)
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, snapshotExtension) {
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{
+			Name:      strings.TrimSuffix(name, snapshotExtension),
+			Size:      object.Size,
+			Timestamp: object.LastModified,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+	})
+	return snapshots, nil
+}
+
+// expiredSnapshots returns the snapshots, sorted newest first, that are
+// neither among the keep most recent ones nor younger than maxAge. A zero
+// keep or maxAge does not limit the snapshots by that criterion.
+func expiredSnapshots(snapshots []snapshotInfo, keep int, maxAge time.Duration, now time.Time) []snapshotInfo {
+	var expired []snapshotInfo
+	for i, snapshot := range snapshots {
+		if (keep > 0 && i >= keep) || (maxAge > 0 && now.Sub(snapshot.Timestamp) > maxAge) {
+			expired = append(expired, snapshot)
+		}
+	}
+	return expired
+}
+
+// applyRetention deletes the snapshots of the cluster that the retention
+// settings of the state no longer keep. The snapshot just saved is always
+// kept.
+func (s *backupStore) applyRetention(ctx context.Context, clusterID int, state state, current string) error {
+	if state.SnapshotRetentionCount <= 0 && state.SnapshotRetentionHours <= 0 {
+		return nil
+	}
+
+	snapshots, err := s.list(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	maxAge := time.Duration(state.SnapshotRetentionHours) * time.Hour
+	for _, snapshot := range expiredSnapshots(snapshots, state.SnapshotRetentionCount, maxAge, time.Now()) {
+		if snapshot.Name == current {
+			continue
+		}
+		if err := s.remove(ctx, clusterID, snapshot.Name); err != nil {
+			return err
+		}
+		reportProgress(ctx, clusterID, "deleted expired snapshot %s", snapshot.Name)
+	}
+	return nil
+}
+
+// recordSnapshots lists the snapshots of the cluster in its metadata.
+func recordSnapshots(ctx context.Context, store *backupStore, clusterID int, info *types.ClusterInfo) error {
+	snapshots, err := store.list(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+	info.Metadata["snapshots"] = string(data)
+	return nil
+}
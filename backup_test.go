@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	snapshots := []snapshotInfo{
+		{Name: "c", Timestamp: now.Add(-time.Hour)},
+		{Name: "b", Timestamp: now.Add(-25 * time.Hour)},
+		{Name: "a", Timestamp: now.Add(-49 * time.Hour)},
+	}
+	names := func(snapshots []snapshotInfo) []string {
+		var names []string
+		for _, snapshot := range snapshots {
+			names = append(names, snapshot.Name)
+		}
+		return names
+	}
+
+	assert.Empty(t, expiredSnapshots(snapshots, 0, 0, now))
+	assert.Equal(t, []string{"b", "a"}, names(expiredSnapshots(snapshots, 1, 0, now)))
+	assert.Equal(t, []string{"a"}, names(expiredSnapshots(snapshots, 0, 48*time.Hour, now)))
+	// Either criterion expires a snapshot
+	assert.Equal(t, []string{"b", "a"}, names(expiredSnapshots(snapshots, 2, 24*time.Hour, now)))
+}
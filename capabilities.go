@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/linode/linodego/k8s"
+	"github.com/rancher/kontainer-engine/drivers/options"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The NodePort range of the API server unless it reports another one
+const defaultNodePortRange = "30000-32767"
+
+// The API server names the valid range when rejecting an invalid NodePort
+var nodePortRangePattern = regexp.MustCompile(`range of valid ports is (\d+-\d+)`)
+
+// ingressControllers maps image name fragments of well-known ingress
+// controllers to their provider names and whether they accept a custom
+// default backend.
+var ingressControllers = []struct {
+	image                string
+	provider             string
+	customDefaultBackend bool
+}{
+	{image: "ingress-nginx/controller", provider: "nginx", customDefaultBackend: true},
+	{image: "nginx-ingress", provider: "nginx", customDefaultBackend: true},
+	{image: "traefik", provider: "traefik"},
+	{image: "haproxy", provider: "haproxy", customDefaultBackend: true},
+	{image: "kong", provider: "kong"},
+	{image: "contour", provider: "contour"},
+	{image: "istio/proxyv2", provider: "istio"},
+}
+
+// staticK8SCapabilities returns the capabilities every LKE cluster has.
+func staticK8SCapabilities() *types.K8SCapabilities {
+	return &types.K8SCapabilities{
+		L4LoadBalancer: &types.LoadBalancerCapabilities{
+			Enabled:              true,
+			Provider:             "NodeBalancer",
+			ProtocolsSupported:   []string{"TCP", "UDP"},
+			HealthCheckSupported: true,
+		},
+		// LKE node pools can be resized through the API, unless the pools of
+		// an existing cluster turn out to be autoscaled
+		NodePoolScalingSupported: true,
+		NodePortRange:            defaultNodePortRange,
+	}
+}
+
+// findClusterByLabel returns the LKE cluster of the account with the label,
+// or nil if there is none.
+func findClusterByLabel(ctx context.Context, client *raw.Client, label string) (*raw.LKECluster, error) {
+	filter, err := json.Marshal(map[string]string{"label": label})
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := client.ListLKEClusters(ctx, raw.NewListOptions(0, string(filter)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list LKE clusters: %s", err)
+	}
+	for i := range clusters {
+		if clusters[i].Label == label {
+			return &clusters[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// nodePoolScalingSupported reports whether the pools can be scaled by the
+// driver. The LKE autoscaler would undo the size of an autoscaled pool.
+func nodePoolScalingSupported(pools []raw.LKENodePool) bool {
+	for _, pool := range pools {
+		if pool.Autoscaler.Enabled {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverK8SCapabilities fills in the capabilities that depend on the pools
+// of the cluster and on what runs in it.
+func discoverK8SCapabilities(ctx context.Context, client *raw.Client, clusterID int, capabilities *types.K8SCapabilities) error {
+	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	}
+	capabilities.NodePoolScalingSupported = nodePoolScalingSupported(pools)
+
+	kubeconfig, err := client.GetLKEClusterKubeconfig(ctx, clusterID)
+	if err != nil {
+		return fmt.Errorf("failed to get kubeconfig for LKE cluster %d: %s", clusterID, err)
+	}
+	clientset, err := k8s.BuildClientsetFromConfig(kubeconfig, nil)
+	if err != nil {
+		return err
+	}
+
+	nodePortRange, err := detectNodePortRange(ctx, clientset)
+	if err != nil {
+		return err
+	}
+	capabilities.NodePortRange = nodePortRange
+
+	ingresses, err := detectIngressControllers(ctx, clientset)
+	if err != nil {
+		return err
+	}
+	capabilities.IngressControllers = ingresses
+	return nil
+}
+
+// detectNodePortRange reads the NodePort range of the API server from the
+// error of a dry run creating a Service with a port outside of any range.
+func detectNodePortRange(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	_, err := clientset.CoreV1().Services(metav1.NamespaceDefault).Create(ctx, &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "lke-node-port-range-"},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{
+				Port:     80,
+				NodePort: 1,
+			}},
+		},
+	}, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err == nil {
+		return "", fmt.Errorf("failed to detect the NodePort range: port 1 was accepted")
+	}
+
+	match := nodePortRangePattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return "", fmt.Errorf("failed to detect the NodePort range: %s", err)
+	}
+	return match[1], nil
+}
+
+// detectIngressControllers finds the ingress controllers deployed in the
+// cluster by the images of its Deployments and DaemonSets.
+func detectIngressControllers(ctx context.Context, clientset kubernetes.Interface) ([]*types.IngressCapabilities, error) {
+	var images []string
+
+	deployments, err := clientset.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Deployments: %s", err)
+	}
+	for _, deployment := range deployments.Items {
+		for _, container := range deployment.Spec.Template.Spec.Containers {
+			images = append(images, container.Image)
+		}
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DaemonSets: %s", err)
+	}
+	for _, ds := range daemonSets.Items {
+		for _, container := range ds.Spec.Template.Spec.Containers {
+			images = append(images, container.Image)
+		}
+	}
+
+	return ingressCapabilities(images), nil
+}
+
+// ingressCapabilities returns the ingress controllers among the images, once
+// per provider and sorted by provider.
+func ingressCapabilities(images []string) []*types.IngressCapabilities {
+	found := map[string]*types.IngressCapabilities{}
+	for _, image := range images {
+		for _, controller := range ingressControllers {
+			if !strings.Contains(image, controller.image) {
+				continue
+			}
+			if _, ok := found[controller.provider]; !ok {
+				found[controller.provider] = &types.IngressCapabilities{
+					IngressProvider:      controller.provider,
+					CustomDefaultBackend: controller.customDefaultBackend,
+				}
+			}
+			break
+		}
+	}
+
+	capabilities := make([]*types.IngressCapabilities, 0, len(found))
+	for _, capability := range found {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Slice(capabilities, func(i, j int) bool {
+		return capabilities[i].IngressProvider < capabilities[j].IngressProvider
+	})
+	return capabilities
+}
+
+// k8sCapabilities returns the capabilities of the cluster described by the
+// options, discovering what it can when the cluster exists. Discovery is best
+// effort, so failures only leave the static capabilities in place.
+func (d *Driver) k8sCapabilities(ctx context.Context, driverOptions *types.DriverOptions) *types.K8SCapabilities {
+	capabilities := staticK8SCapabilities()
+
+	// The options may not describe a complete cluster, so only read what
+	// identifies it instead of validating all of them
+	token := options.GetValueFromDriverOptions(driverOptions, types.StringType, "access-token", "accessToken").(string)
+	label := options.GetValueFromDriverOptions(driverOptions, types.StringType, "label").(string)
+	if token == "" || label == "" {
+		return capabilities
+	}
+
+	client, err := d.getServiceClient(ctx, token)
+	if err != nil {
+		logrus.Debugf("failed to discover Kubernetes capabilities: %s", err)
+		return capabilities
+	}
+
+	cluster, err := findClusterByLabel(ctx, client, label)
+	if err != nil || cluster == nil {
+		if err != nil {
+			logrus.Debugf("failed to discover Kubernetes capabilities: %s", err)
+		}
+		return capabilities
+	}
+
+	discovered := staticK8SCapabilities()
+	if err := discoverK8SCapabilities(ctx, client, cluster.ID, discovered); err != nil {
+		logrus.Debugf("failed to discover Kubernetes capabilities of LKE cluster %d: %s", cluster.ID, err)
+		return capabilities
+	}
+	return discovered
+}
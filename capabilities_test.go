@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngressCapabilities(t *testing.T) {
+	capabilities := ingressCapabilities([]string{
+		"traefik:v2.10",
+		"registry.k8s.io/ingress-nginx/controller:v1.9.4",
+		"registry.k8s.io/coredns/coredns:v1.10.1",
+		"nginx/nginx-ingress:3.3.2",
+	})
+
+	if assert.Len(t, capabilities, 2) {
+		assert.Equal(t, "nginx", capabilities[0].IngressProvider)
+		assert.True(t, capabilities[0].CustomDefaultBackend)
+		assert.Equal(t, "traefik", capabilities[1].IngressProvider)
+		assert.False(t, capabilities[1].CustomDefaultBackend)
+	}
+	assert.Empty(t, ingressCapabilities(nil))
+}
+
+func TestNodePoolScalingSupported(t *testing.T) {
+	assert.True(t, nodePoolScalingSupported(nil))
+	assert.True(t, nodePoolScalingSupported([]raw.LKENodePool{{ID: 1}, {ID: 2}}))
+	assert.False(t, nodePoolScalingSupported([]raw.LKENodePool{
+		{ID: 1},
+		{ID: 2, Autoscaler: raw.LKENodePoolAutoscaler{Enabled: true, Min: 1, Max: 3}},
+	}))
+}
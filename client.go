@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	raw "github.com/linode/linodego"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// The shared token bucket refills at apiRequestRate requests per second
+	// and holds up to apiRequestBurst requests
+	apiRequestRate  = 5
+	apiRequestBurst = 10
+
+	// Requests are retried up to apiMaxRetries times, waiting at most
+	// apiMaxRetryWait between attempts
+	apiMaxRetries   = 10
+	apiMaxRetryWait = 2 * time.Minute
+	// How long to back off after a 429 without a Retry-After header
+	apiDefaultBackoff = 10 * time.Second
+)
+
+type clientCacheKey struct {
+	// A hash of the token, so that tokens are not kept around as map keys
+	token   string
+	baseURL string
+}
+
+var (
+	clientCacheLock sync.Mutex
+	clientCache     = map[clientCacheKey]*raw.Client{}
+
+	// apiThrottles holds a throttle per token hash, shared by the clients of
+	// the token, since the rate limits of a token apply across all the
+	// clusters using it
+	apiThrottles = map[string]*throttle{}
+)
+
+// linodeClient returns the client of the process for the token and base URL,
+// creating it on first use.
+func linodeClient(token string, baseURL string) *raw.Client {
+	hash := sha256.Sum256([]byte(token))
+	key := clientCacheKey{token: hex.EncodeToString(hash[:]), baseURL: baseURL}
+
+	clientCacheLock.Lock()
+	defer clientCacheLock.Unlock()
+
+	if client, ok := clientCache[key]; ok {
+		return client
+	}
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	oauthTransport := &oauth2.Transport{
+		Source: tokenSource,
+	}
+
+	apiThrottle, ok := apiThrottles[key.token]
+	if !ok {
+		apiThrottle = newThrottle(rate.NewLimiter(apiRequestRate, apiRequestBurst))
+		apiThrottles[key.token] = apiThrottle
+	}
+
+	oauth2Client := &http.Client{
+		Transport: tracedTransport(&instrumentedTransport{
+			next: &throttledTransport{throttle: apiThrottle, next: oauthTransport},
+		}),
+	}
+	client := raw.NewClient(oauth2Client)
+
+	client.SetUserAgent("kontainer-engine-driver-lke")
+	client.SetBaseURL(baseURL)
+
+	// NewClient already retries 429s, "Linode busy" errors and the like, but
+	// would retry up to a thousand times
+	client.SetRetryCount(apiMaxRetries)
+	client.SetRetryMaxWaitTime(apiMaxRetryWait)
+	client.SetRetryAfter(retryAfter)
+	countRetries(&client)
+
+	clientCache[key] = &client
+	return &client
+}
+
+// retryAfter waits as long as the Retry-After header of the response asks
+// for, falling back to the backoff of resty.
+func retryAfter(_ *resty.Client, resp *resty.Response) (time.Duration, error) {
+	if delay, ok := retryAfterDelay(resp.Header()); ok {
+		return delay, nil
+	}
+	return 0, nil
+}
+
+func retryAfterDelay(header http.Header) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// throttle is a token bucket that can be paused, so that every request backs
+// off once the API signals that the rate limit was hit.
+type throttle struct {
+	limiter *rate.Limiter
+
+	lock        sync.Mutex
+	pausedUntil time.Time
+}
+
+func newThrottle(limiter *rate.Limiter) *throttle {
+	return &throttle{limiter: limiter}
+}
+
+// wait blocks until a request may be sent.
+func (t *throttle) wait(ctx context.Context) error {
+	t.lock.Lock()
+	pause := time.Until(t.pausedUntil)
+	t.lock.Unlock()
+
+	if pause > 0 {
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// backoff pauses all requests for the given duration.
+func (t *throttle) backoff(pause time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if until := time.Now().Add(pause); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+// throttledTransport sends requests through the throttle and backs off when
+// the API answers with 429 Too Many Requests.
+type throttledTransport struct {
+	throttle *throttle
+	next     http.RoundTripper
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.throttle.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		pause, ok := retryAfterDelay(resp.Header)
+		if !ok {
+			pause = apiDefaultBackoff
+		}
+		logrus.Debugf("Linode API rate limit hit, backing off for %s", pause)
+		t.throttle.backoff(pause)
+	}
+	return resp, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestLinodeClientIsCached(t *testing.T) {
+	a := linodeClient("token-a", DefaultLinodeURL)
+
+	assert.Same(t, a, linodeClient("token-a", DefaultLinodeURL))
+	assert.NotSame(t, a, linodeClient("token-b", DefaultLinodeURL))
+	assert.NotSame(t, a, linodeClient("token-a", "https://api.example.com"))
+}
+
+func TestLinodeClientThrottlePerToken(t *testing.T) {
+	linodeClient("token-c", DefaultLinodeURL)
+	linodeClient("token-c", "https://api.example.com")
+	linodeClient("token-d", DefaultLinodeURL)
+
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	assert.NotNil(t, apiThrottles[hash("token-c")])
+	assert.NotSame(t, apiThrottles[hash("token-c")], apiThrottles[hash("token-d")])
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	delay, ok := retryAfterDelay(http.Header{"Retry-After": []string{"3"}})
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+
+	_, ok = retryAfterDelay(http.Header{})
+	assert.False(t, ok)
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	throttle := newThrottle(rate.NewLimiter(rate.Inf, 1))
+	throttle.backoff(time.Minute)
+	// A shorter backoff does not cut the pause short
+	throttle.backoff(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, throttle.wait(ctx))
+
+	assert.NoError(t, newThrottle(rate.NewLimiter(rate.Inf, 1)).wait(context.Background()))
+}
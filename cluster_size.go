@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Cluster size strategies decide how SetClusterSize spreads the requested
+// node count across the pools of the cluster.
+const (
+	// sizeStrategyProportional keeps the ratio between the pools
+	sizeStrategyProportional = "proportional"
+	// sizeStrategyScalablePool only resizes the pool of the scalable node type
+	sizeStrategyScalablePool = "scalable-pool"
+	// sizeStrategyLargestPool only resizes the largest pool
+	sizeStrategyLargestPool = "largest-pool"
+)
+
+func addClusterSizeFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["cluster-size-strategy"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "How a new cluster size is spread across pools: proportional, scalable-pool or largest-pool",
+		Default: &types.Default{
+			DefaultString: sizeStrategyProportional,
+		},
+	}
+	driverFlag.Options["scalable-pool"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "The node type of the pool resized by the scalable-pool cluster size strategy",
+	}
+}
+
+// distributeNodeCount returns the new node count of every pool, keyed by pool
+// ID, so that the counts add up to total. Every pool keeps at least one node.
+func distributeNodeCount(pools []raw.LKENodePool, total int, strategy string, scalablePool string) (map[int]int, error) {
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("cluster has no node pools to resize")
+	}
+
+	counts := make(map[int]int, len(pools))
+	for _, pool := range pools {
+		counts[pool.ID] = pool.Count
+	}
+
+	switch strategy {
+	case "", sizeStrategyProportional:
+		return distributeProportionally(pools, total)
+	case sizeStrategyScalablePool:
+		for _, pool := range pools {
+			if pool.Type == scalablePool {
+				return resizeSinglePool(counts, pool.ID, total)
+			}
+		}
+		return nil, fmt.Errorf("no node pool of scalable type %q", scalablePool)
+	case sizeStrategyLargestPool:
+		largest := pools[0]
+		for _, pool := range pools[1:] {
+			if pool.Count > largest.Count || (pool.Count == largest.Count && pool.ID < largest.ID) {
+				largest = pool
+			}
+		}
+		return resizeSinglePool(counts, largest.ID, total)
+	default:
+		return nil, fmt.Errorf("unknown cluster size strategy %q", strategy)
+	}
+}
+
+// resizeSinglePool gives the given pool whatever is left of total after the
+// other pools.
+func resizeSinglePool(counts map[int]int, poolID int, total int) (map[int]int, error) {
+	others := 0
+	for id, count := range counts {
+		if id != poolID {
+			others += count
+		}
+	}
+	if total-others < 1 {
+		return nil, fmt.Errorf("cluster size %d leaves no nodes for node pool %d", total, poolID)
+	}
+	counts[poolID] = total - others
+	return counts, nil
+}
+
+// distributeProportionally spreads the difference between total and the
+// current cluster size across the pools according to their current sizes,
+// using the largest remainder method. Every pool keeps at least one node, and
+// the pools are left alone if the size does not change.
+func distributeProportionally(pools []raw.LKENodePool, total int) (map[int]int, error) {
+	if total < len(pools) {
+		return nil, fmt.Errorf("cluster size %d is smaller than the number of node pools %d", total, len(pools))
+	}
+
+	weight := 0
+	counts := make(map[int]int, len(pools))
+	for _, pool := range pools {
+		weight += pool.Count
+		counts[pool.ID] = pool.Count
+	}
+	if total == weight {
+		return counts, nil
+	}
+	if weight == 0 {
+		return nil, fmt.Errorf("cluster has no nodes to scale from")
+	}
+
+	step, delta := 1, total-weight
+	if delta < 0 {
+		step, delta = -1, -delta
+	}
+
+	type share struct {
+		poolID    int
+		remainder int
+	}
+
+	shares := make([]share, 0, len(pools))
+	assigned := 0
+	for _, pool := range pools {
+		// When shrinking, delta is below weight by at least one node per
+		// pool, so this never takes a pool's last node
+		n := delta * pool.Count / weight
+		counts[pool.ID] += step * n
+		assigned += n
+		shares = append(shares, share{poolID: pool.ID, remainder: delta * pool.Count % weight})
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].remainder != shares[j].remainder {
+			return shares[i].remainder > shares[j].remainder
+		}
+		return shares[i].poolID < shares[j].poolID
+	})
+	for left := delta - assigned; left > 0; {
+		for _, share := range shares {
+			if left == 0 {
+				break
+			}
+			if step < 0 && counts[share.poolID] == 1 {
+				continue
+			}
+			counts[share.poolID] += step
+			left--
+		}
+	}
+
+	return counts, nil
+}
+
+// resizePools resizes every pool to its count and waits for it to converge.
+// Pools whose count does not change are not waited on, so that a node the
+// resize did not touch cannot fail it.
+func resizePools(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	pools []raw.LKENodePool,
+	counts map[int]int,
+	timeouts waitTimeouts,
+) error {
+	for _, pool := range pools {
+		poolCount := counts[pool.ID]
+		if poolCount == pool.Count {
+			continue
+		}
+
+		var err error
+		if poolCount < pool.Count {
+			err = removePoolNodes(ctx, client, clientset, clusterID, pool, pool.Count-poolCount, timeouts)
+		} else {
+			_, err = client.UpdateLKENodePool(ctx, clusterID, pool.ID, raw.LKENodePoolUpdateOptions{
+				Count: poolCount,
+			})
+		}
+		if err == nil {
+			err = waitUntilPoolConverged(ctx, client, clientset, clusterID, pool.ID, poolCount, timeouts.PoolReady)
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"failed to update LKE Cluster %d Node Pool %d: %w",
+				clusterID,
+				pool.ID,
+				err,
+			)
+		}
+		reportProgress(ctx, clusterID, "pool %d resized from %d to %d nodes", pool.ID, pool.Count, poolCount)
+	}
+	return nil
+}
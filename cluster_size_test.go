@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistributeNodeCount(t *testing.T) {
+	pools := []raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-1", Count: 3},
+		{ID: 2, Type: "g6-standard-2", Count: 1},
+	}
+
+	tests := []struct {
+		name     string
+		total    int
+		strategy string
+		scalable string
+		expected map[int]int
+		err      bool
+	}{
+		{name: "proportional grow", total: 8, strategy: sizeStrategyProportional, expected: map[int]int{1: 6, 2: 2}},
+		{name: "proportional shrink", total: 2, strategy: sizeStrategyProportional, expected: map[int]int{1: 1, 2: 1}},
+		{name: "proportional unchanged", total: 4, strategy: "", expected: map[int]int{1: 3, 2: 1}},
+		{name: "proportional too small", total: 1, strategy: sizeStrategyProportional, err: true},
+		{name: "scalable pool", total: 6, strategy: sizeStrategyScalablePool, scalable: "g6-standard-2", expected: map[int]int{1: 3, 2: 3}},
+		{name: "scalable pool missing", total: 6, strategy: sizeStrategyScalablePool, scalable: "g6-standard-8", err: true},
+		{name: "scalable pool too small", total: 3, strategy: sizeStrategyScalablePool, scalable: "g6-standard-2", err: true},
+		{name: "largest pool", total: 6, strategy: sizeStrategyLargestPool, expected: map[int]int{1: 5, 2: 1}},
+		{name: "unknown strategy", total: 6, strategy: "random", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, err := distributeNodeCount(pools, tt.total, tt.strategy, tt.scalable)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, counts)
+		})
+	}
+
+	// The pools are not rebalanced when the size does not change, and only
+	// the difference is spread when it does
+	counts, err := distributeNodeCount([]raw.LKENodePool{{ID: 1, Count: 5}, {ID: 2, Count: 1}}, 6, sizeStrategyProportional, "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{1: 5, 2: 1}, counts)
+	counts, err = distributeNodeCount([]raw.LKENodePool{{ID: 1, Count: 10}, {ID: 2, Count: 2}}, 13, sizeStrategyProportional, "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{1: 11, 2: 2}, counts)
+
+	_, err = distributeNodeCount(nil, 3, sizeStrategyProportional, "")
+	assert.Error(t, err, "empty pool list")
+}
+
+func TestResizePoolsSkipsUnchangedPools(t *testing.T) {
+	api, client := newFakeLinodeAPI(t,
+		raw.LKENodePool{ID: 1, Type: "g6-standard-1", Count: 2, Linodes: []raw.LKENodePoolLinode{
+			{ID: "1-a", InstanceID: 1, Status: raw.LKELinodeReady},
+			{ID: "1-b", InstanceID: 2, Status: raw.LKELinodeReady},
+		}},
+		// The resize must not wait on this pool
+		raw.LKENodePool{ID: 2, Type: "g6-standard-2", Count: 1, Linodes: []raw.LKENodePoolLinode{
+			{ID: "2-a", InstanceID: 3, Status: raw.LKELinodeNotReady},
+		}},
+	)
+	pools, err := client.ListLKENodePools(context.Background(), 1, nil)
+	assert.NoError(t, err)
+
+	err = resizePools(context.Background(), client, nil, 1, pools, map[int]int{1: 3, 2: 1},
+		waitTimeouts{PoolReady: 200 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"g6-standard-1": 3, "g6-standard-2": 1}, api.counts())
+}
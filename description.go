@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LKE has no description field, so the description is kept in a tag of the
+// cluster and in full in an annotation of a ConfigMap in the cluster.
+const (
+	descriptionTagPrefix     = "description:"
+	descriptionAnnotation    = "lke.linode.com/description"
+	descriptionConfigMap     = "lke-cluster-info"
+	descriptionConfigMapNS   = metav1.NamespaceSystem
+	maxTagLength             = 50
+	truncatedDescriptionMark = "..."
+)
+
+// descriptionTag returns the tag carrying the description, shortened to fit
+// the tag length limit, or an empty string if there is no description.
+func descriptionTag(description string) string {
+	description = strings.TrimSpace(description)
+	if description == "" {
+		return ""
+	}
+	tag := descriptionTagPrefix + description
+	if len(tag) > maxTagLength {
+		// Cut at a rune boundary so the tag stays valid UTF-8
+		cut := maxTagLength - len(truncatedDescriptionMark)
+		for cut > 0 && !utf8.RuneStart(tag[cut]) {
+			cut--
+		}
+		tag = tag[:cut] + truncatedDescriptionMark
+	}
+	return tag
+}
+
+func isDescriptionTag(tag string) bool {
+	return strings.HasPrefix(tag, descriptionTagPrefix)
+}
+
+// clusterTags returns the tags of the LKE cluster: the configured tags and
+// the description tag.
+func (s *state) clusterTags() []string {
+	tags := make([]string, 0, len(s.Tags)+1)
+	for _, tag := range s.Tags {
+		if !isDescriptionTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if tag := descriptionTag(s.Description); tag != "" {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// splitDescriptionTag separates the description tag from the other tags.
+func splitDescriptionTag(tags []string) ([]string, string) {
+	others := make([]string, 0, len(tags))
+	description := ""
+	for _, tag := range tags {
+		if isDescriptionTag(tag) {
+			description = tag
+			continue
+		}
+		others = append(others, tag)
+	}
+	return others, description
+}
+
+// syncDescription records the description as an annotation of a ConfigMap in
+// the cluster, removing the annotation if there is no description.
+func syncDescription(ctx context.Context, clientset kubernetes.Interface, description string) error {
+	configMaps := clientset.CoreV1().ConfigMaps(descriptionConfigMapNS)
+
+	configMap, err := configMaps.Get(ctx, descriptionConfigMap, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if description == "" {
+			return nil
+		}
+		_, err = configMaps.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        descriptionConfigMap,
+				Namespace:   descriptionConfigMapNS,
+				Annotations: map[string]string{descriptionAnnotation: description},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create ConfigMap %s/%s: %s", descriptionConfigMapNS, descriptionConfigMap, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %s", descriptionConfigMapNS, descriptionConfigMap, err)
+	}
+
+	if configMap.Annotations[descriptionAnnotation] == description {
+		return nil
+	}
+	if description == "" {
+		delete(configMap.Annotations, descriptionAnnotation)
+	} else {
+		if configMap.Annotations == nil {
+			configMap.Annotations = map[string]string{}
+		}
+		configMap.Annotations[descriptionAnnotation] = description
+	}
+
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s: %s", descriptionConfigMapNS, descriptionConfigMap, err)
+	}
+	logrus.Debugf("updated the description annotation of ConfigMap %s/%s", descriptionConfigMapNS, descriptionConfigMap)
+	return nil
+}
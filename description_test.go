@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescriptionTag(t *testing.T) {
+	assert.Equal(t, "", descriptionTag("  "))
+	assert.Equal(t, "description:team a", descriptionTag("team a"))
+
+	tag := descriptionTag(strings.Repeat("x", 100))
+	assert.Len(t, tag, maxTagLength)
+	assert.True(t, strings.HasSuffix(tag, truncatedDescriptionMark))
+
+	tag = descriptionTag(strings.Repeat("é", 50))
+	assert.True(t, utf8.ValidString(tag))
+	assert.LessOrEqual(t, len(tag), maxTagLength)
+	assert.Equal(t, descriptionTagPrefix+strings.Repeat("é", 17)+truncatedDescriptionMark, tag)
+}
+
+func TestClusterTags(t *testing.T) {
+	s := state{Tags: []string{"a", "description:stale"}, Description: "team a"}
+	assert.Equal(t, []string{"a", "description:team a"}, s.clusterTags())
+
+	tags, description := splitDescriptionTag(s.clusterTags())
+	assert.Equal(t, []string{"a"}, tags)
+	assert.Equal(t, "description:team a", description)
+}
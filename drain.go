@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/linode/linodego/k8s"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const mirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+// evictionRetryPeriod is a variable so that tests need not wait for it
+var evictionRetryPeriod = 5 * time.Second
+
+// getClusterClientset builds a clientset from the kubeconfig stored by
+// PostCheck. A nil clientset is returned if no kubeconfig is known yet.
+func getClusterClientset(info *types.ClusterInfo) (kubernetes.Interface, error) {
+	if !exists(info.Metadata, "KubeConfig") {
+		return nil, nil
+	}
+
+	return k8s.BuildClientsetFromConfig(&raw.LKEClusterKubeconfig{
+		KubeConfig: info.Metadata["KubeConfig"],
+	}, nil)
+}
+
+// poolNodeNames maps the LKE node IDs of the pool to their Kubernetes node
+// names, which match the labels of the backing Linode instances.
+func poolNodeNames(ctx context.Context, client *raw.Client, pool raw.LKENodePool) (map[string]string, error) {
+	names := make(map[string]string, len(pool.Linodes))
+	for _, linode := range pool.Linodes {
+		instance, err := client.GetInstance(ctx, linode.InstanceID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instance %d of node %s: %s", linode.InstanceID, linode.ID, err)
+		}
+		names[linode.ID] = instance.Label
+	}
+	return names, nil
+}
+
+// selectNodesForRemoval picks count nodes of the pool to remove, preferring
+// nodes that are not ready and then nodes running the fewest pods.
+func selectNodesForRemoval(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	pool raw.LKENodePool,
+	names map[string]string,
+	count int,
+) []string {
+	podCounts := map[string]int{}
+	if clientset != nil {
+		for _, linode := range pool.Linodes {
+			pods, err := nodePods(ctx, clientset, names[linode.ID])
+			if err != nil {
+				logrus.Debugf("failed to list pods of node %s: %s", names[linode.ID], err)
+				continue
+			}
+			podCounts[linode.ID] = len(pods)
+		}
+	}
+
+	nodes := append([]raw.LKENodePoolLinode{}, pool.Linodes...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		iReady := nodes[i].Status == raw.LKELinodeReady
+		jReady := nodes[j].Status == raw.LKELinodeReady
+		if iReady != jReady {
+			return !iReady
+		}
+		if podCounts[nodes[i].ID] != podCounts[nodes[j].ID] {
+			return podCounts[nodes[i].ID] < podCounts[nodes[j].ID]
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	if count > len(nodes) {
+		count = len(nodes)
+	}
+	selected := make([]string, 0, count)
+	for _, node := range nodes[:count] {
+		selected = append(selected, node.ID)
+	}
+	return selected
+}
+
+// removePoolNodes shrinks the pool by count nodes. The nodes to remove are
+// chosen by the driver, cordoned and drained before they are deleted.
+func removePoolNodes(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	pool raw.LKENodePool,
+	count int,
+	timeouts waitTimeouts,
+) error {
+	names, err := poolNodeNames(ctx, client, pool)
+	if err != nil {
+		return err
+	}
+
+	nodeIDs := selectNodesForRemoval(ctx, clientset, pool, names, count)
+	reportProgress(ctx, clusterID, "removing nodes %v from pool %d", nodeIDs, pool.ID)
+
+	return deletePoolNodes(ctx, client, clientset, clusterID, pool.ID, nodeIDs, names, timeouts)
+}
+
+// deletePoolNodes drains the given nodes and deletes them from the pool.
+func deletePoolNodes(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	poolID int,
+	nodeIDs []string,
+	names map[string]string,
+	timeouts waitTimeouts,
+) error {
+	if clientset == nil {
+		reportWarning(ctx, clusterID, "no kubeconfig available, deleting nodes %v without draining", nodeIDs)
+	} else {
+		for _, nodeID := range nodeIDs {
+			if err := cordonNode(ctx, clientset, names[nodeID]); err != nil {
+				return err
+			}
+		}
+		for _, nodeID := range nodeIDs {
+			if err := drainNode(ctx, clientset, clusterID, names[nodeID], timeouts.Drain); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, nodeID := range nodeIDs {
+		if err := client.DeleteLKENodePoolNode(ctx, clusterID, nodeID); err != nil {
+			return fmt.Errorf("failed to delete node %s of LKE cluster %d: %s", nodeID, clusterID, err)
+		}
+	}
+
+	return waitUntilPoolNodesReplaced(ctx, client, clusterID, poolID, sets.NewString(nodeIDs...), timeouts.PoolReady)
+}
+
+// drainPool cordons every node of the pool and then drains them one by one,
+// so that evicted pods are not rescheduled onto the same pool.
+func drainPool(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	pool raw.LKENodePool,
+	timeouts waitTimeouts,
+) error {
+	if clientset == nil {
+		reportWarning(ctx, clusterID, "no kubeconfig available, deleting pool %d without draining", pool.ID)
+		return nil
+	}
+
+	names, err := poolNodeNames(ctx, client, pool)
+	if err != nil {
+		return err
+	}
+
+	nodeIDs := poolNodeIDs(pool).List()
+	for _, nodeID := range nodeIDs {
+		if err := cordonNode(ctx, clientset, names[nodeID]); err != nil {
+			return err
+		}
+	}
+	for _, nodeID := range nodeIDs {
+		if err := drainNode(ctx, clientset, clusterID, names[nodeID], timeouts.Drain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cordonNode marks the node as unschedulable.
+func cordonNode(ctx context.Context, clientset kubernetes.Interface, name string) error {
+	patch := []byte(`{"spec":{"unschedulable":true}}`)
+	_, err := clientset.CoreV1().Nodes().Patch(ctx, name, k8stypes.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to cordon node %s: %s", name, err)
+	}
+	return nil
+}
+
+// drainNode evicts every pod that is not managed by a DaemonSet from the
+// node. Evictions blocked by a PodDisruptionBudget are retried until the
+// drain times out.
+func drainNode(ctx context.Context, clientset kubernetes.Interface, clusterID int, name string, timeout time.Duration) error {
+	reportProgress(ctx, clusterID, "draining node %s", name)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pods, err := nodePods(ctx, clientset, name)
+	if err != nil {
+		return fmt.Errorf("failed to list pods of node %s: %s", name, err)
+	}
+
+	for _, pod := range pods {
+		if err := evictPod(ctx, clientset, pod); err != nil {
+			return fmt.Errorf("failed to drain node %s: %s", name, err)
+		}
+	}
+
+	err = wait.PollImmediateUntil(evictionRetryPeriod, func() (bool, error) {
+		remaining, err := nodePods(ctx, clientset, name)
+		if err != nil {
+			return false, nil
+		}
+		return len(remaining) == 0, nil
+	}, ctx.Done())
+	if err != nil {
+		return fmt.Errorf("timed out waiting for pods to leave node %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// eviction is a policy/v1 Eviction. The vendored client-go predates the
+// policy/v1 client, and policy/v1beta1 is deprecated since Kubernetes 1.22,
+// so evictions are posted to the eviction subresource of the pod directly.
+type eviction struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+}
+
+// evictPod evicts the pod, retrying while a PodDisruptionBudget blocks the
+// eviction.
+func evictPod(ctx context.Context, clientset kubernetes.Interface, pod v1.Pod) error {
+	body, err := json.Marshal(eviction{
+		TypeMeta: metav1.TypeMeta{APIVersion: "policy/v1", Kind: "Eviction"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return wait.PollImmediateUntil(evictionRetryPeriod, func() (bool, error) {
+		err := clientset.CoreV1().RESTClient().Post().
+			Namespace(pod.Namespace).
+			Resource("pods").
+			Name(pod.Name).
+			SubResource("eviction").
+			Body(body).
+			Do(ctx).
+			Error()
+		switch {
+		case err == nil, errors.IsNotFound(err):
+			return true, nil
+		case errors.IsTooManyRequests(err):
+			// The eviction would violate a PodDisruptionBudget
+			logrus.Debugf("eviction of pod %s/%s blocked, retrying: %s", pod.Namespace, pod.Name, err)
+			return false, nil
+		default:
+			return false, fmt.Errorf("failed to evict pod %s/%s: %s", pod.Namespace, pod.Name, err)
+		}
+	}, ctx.Done())
+}
+
+// nodePods lists the pods of the node that have to be evicted in a drain.
+func nodePods(ctx context.Context, clientset kubernetes.Interface, name string) ([]v1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []v1.Pod
+	for _, pod := range podList.Items {
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			continue
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if controller := metav1.GetControllerOf(&pod); controller != nil && controller.Kind == "DaemonSet" {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
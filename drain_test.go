@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	podsResource = v1.SchemeGroupVersion.WithResource("pods")
+	podKind      = v1.SchemeGroupVersion.WithKind("Pod")
+)
+
+func nodePod(name string, nodeName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+// fakeClientset returns a fake clientset that, unlike the stock one, honors
+// the field selector of pod lists.
+func fakeClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		list, err := clientset.Tracker().List(podsResource, podKind, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		pods := list.(*v1.PodList)
+		var items []v1.Pod
+		for _, pod := range pods.Items {
+			if selector.Matches(fields.Set{"spec.nodeName": pod.Spec.NodeName}) {
+				items = append(items, pod)
+			}
+		}
+		pods.Items = items
+		return true, pods, nil
+	})
+	return clientset
+}
+
+func TestSelectNodesForRemoval(t *testing.T) {
+	ctx := context.Background()
+	pool := raw.LKENodePool{ID: 1, Linodes: []raw.LKENodePoolLinode{
+		{ID: "1-a", Status: raw.LKELinodeReady},
+		{ID: "1-b", Status: raw.LKELinodeReady},
+		{ID: "1-c", Status: raw.LKELinodeNotReady},
+	}}
+	names := map[string]string{"1-a": "node-a", "1-b": "node-b", "1-c": "node-c"}
+	clientset := fakeClientset(nodePod("web-1", "node-a"), nodePod("web-2", "node-a"), nodePod("web-3", "node-b"))
+
+	assert.Equal(t, []string{"1-c", "1-b"}, selectNodesForRemoval(ctx, clientset, pool, names, 2))
+	assert.Equal(t, []string{"1-c", "1-a", "1-b"}, selectNodesForRemoval(ctx, nil, pool, names, 5))
+}
+
+func TestDrainNodeRetriesBlockedEvictions(t *testing.T) {
+	defer func(period time.Duration) { evictionRetryPeriod = period }(evictionRetryPeriod)
+	evictionRetryPeriod = 10 * time.Millisecond
+
+	controller := true
+	daemonPod := nodePod("agent", "node-a")
+	daemonPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "agent", Controller: &controller}}
+	pods := []v1.Pod{*nodePod("web-1", "node-a"), *daemonPod}
+
+	var lock sync.Mutex
+	var evicted []string
+	attempts := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/pods", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, "spec.nodeName=node-a", r.URL.Query().Get("fieldSelector"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v1.PodList{Items: pods})
+	})
+	mux.HandleFunc("/api/v1/namespaces/default/pods/web-1/eviction", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		var eviction eviction
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&eviction))
+		assert.Equal(t, "policy/v1", eviction.APIVersion)
+
+		w.Header().Set("Content-Type", "application/json")
+		// The first attempts would violate a PodDisruptionBudget
+		if attempts++; attempts < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonTooManyRequests,
+				Code:    http.StatusTooManyRequests,
+				Message: "Cannot evict pod as it would violate the pod's disruption budget.",
+			})
+			return
+		}
+		evicted = append(evicted, eviction.Name)
+		pods = pods[1:]
+		_ = json.NewEncoder(w).Encode(metav1.Status{Status: metav1.StatusSuccess})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+
+	assert.NoError(t, drainNode(context.Background(), clientset, 12, "node-a", time.Minute))
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []string{"web-1"}, evicted)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Drift policies decide what happens when the live cluster no longer matches
+// the stored state, e.g. after it was changed in Cloud Manager.
+const (
+	// driftPolicyReport only records the drift in the cluster metadata
+	driftPolicyReport = "report"
+	// driftPolicyReconcile changes the live cluster back to the stored state
+	driftPolicyReconcile = "reconcile"
+	// driftPolicyAdopt takes the live values into the stored state
+	driftPolicyAdopt = "adopt"
+)
+
+func addDriftFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["drift-policy"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "What to do when the live cluster drifted from its configuration: report, reconcile or adopt",
+		Default: &types.Default{
+			DefaultString: driftPolicyReport,
+		},
+	}
+}
+
+// driftChange is a difference between the stored state and the live cluster
+type driftChange struct {
+	Field  string
+	Stored string
+	Live   string
+}
+
+func (c driftChange) String() string {
+	return fmt.Sprintf("%s: stored %s, live %s", c.Field, c.Stored, c.Live)
+}
+
+// detectDrift compares the stored state against the live cluster and its node
+// pools. Fields the state does not know about are not compared.
+func detectDrift(state state, cluster *raw.LKECluster, pools []raw.LKENodePool) []driftChange {
+	var drift []driftChange
+
+	if state.Label != "" && state.Label != cluster.Label {
+		drift = append(drift, driftChange{Field: "label", Stored: state.Label, Live: cluster.Label})
+	}
+
+	if tags := state.clusterTags(); !sets.NewString(tags...).Equal(sets.NewString(cluster.Tags...)) {
+		drift = append(drift, driftChange{
+			Field:  "tags",
+			Stored: fmt.Sprint(sets.NewString(tags...).List()),
+			Live:   fmt.Sprint(sets.NewString(cluster.Tags...).List()),
+		})
+	}
+
+	if state.HighAvailability != nil && *state.HighAvailability != cluster.ControlPlane.HighAvailability {
+		drift = append(drift, driftChange{
+			Field:  "high-availability",
+			Stored: strconv.FormatBool(*state.HighAvailability),
+			Live:   strconv.FormatBool(cluster.ControlPlane.HighAvailability),
+		})
+	}
+
+	// States stored before node pools were tracked reliably have none
+	if len(state.NodePools) == 0 {
+		return drift
+	}
+
+	live := livePoolCounts(pools)
+	nodeTypes := sets.StringKeySet(live).Union(sets.StringKeySet(state.NodePools)).List()
+	sort.Strings(nodeTypes)
+	for _, t := range nodeTypes {
+		stored, inState := state.NodePools[t]
+		count, inCluster := live[t]
+		if inState && inCluster && stored == count {
+			continue
+		}
+		change := driftChange{Field: "node-pool " + t, Stored: "absent", Live: "absent"}
+		if inState {
+			change.Stored = strconv.Itoa(stored)
+		}
+		if inCluster {
+			change.Live = strconv.Itoa(count)
+		}
+		drift = append(drift, change)
+	}
+
+	return drift
+}
+
+// resizedBySetClusterSize reports whether the live pools differ from the
+// stored ones only as SetClusterSize would have resized them. That RPC cannot
+// store the new pool sizes, so such a difference is not drift.
+func resizedBySetClusterSize(state state, pools []raw.LKENodePool) bool {
+	live := livePoolCounts(pools)
+	if len(state.NodePools) == 0 || !sets.StringKeySet(live).Equal(sets.StringKeySet(state.NodePools)) {
+		return false
+	}
+
+	total := 0
+	for _, count := range live {
+		total += count
+	}
+
+	// SetClusterSize resizes pools, so model one pool per stored node type
+	nodeTypes := sets.StringKeySet(state.NodePools).List()
+	stored := make([]raw.LKENodePool, 0, len(nodeTypes))
+	for i, t := range nodeTypes {
+		stored = append(stored, raw.LKENodePool{ID: i, Type: t, Count: state.NodePools[t]})
+	}
+	counts, err := distributeNodeCount(stored, total, state.ClusterSizeStrategy, state.ScalablePool)
+	if err != nil {
+		return false
+	}
+	for _, pool := range stored {
+		if counts[pool.ID] != live[pool.Type] {
+			return false
+		}
+	}
+	return true
+}
+
+// livePoolCounts sums the node counts of the pools by node type.
+func livePoolCounts(pools []raw.LKENodePool) map[string]int {
+	counts := make(map[string]int, len(pools))
+	for _, pool := range pools {
+		counts[pool.Type] += pool.Count
+	}
+	return counts
+}
+
+// checkDrift detects drift of the live cluster, as fetched by the caller, and
+// handles it according to the policy. The drift is recorded in the "drift" metadata key until it is
+// resolved.
+func checkDrift(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	info *types.ClusterInfo,
+	state *state,
+	policy string,
+	cluster *raw.LKECluster,
+	pools []raw.LKENodePool,
+) error {
+	if resizedBySetClusterSize(*state, pools) {
+		if live := livePoolCounts(pools); !reflect.DeepEqual(live, state.NodePools) {
+			state.NodePools = live
+			if err := storeState(info, *state); err != nil {
+				return err
+			}
+		}
+	}
+
+	drift := detectDrift(*state, cluster, pools)
+	if len(drift) == 0 {
+		delete(info.Metadata, "drift")
+		return nil
+	}
+
+	bytes, err := json.Marshal(drift)
+	if err != nil {
+		return err
+	}
+	info.Metadata["drift"] = string(bytes)
+	reportWarning(ctx, clusterID, "drifted from its configuration: %v", drift)
+
+	switch policy {
+	case "", driftPolicyReport:
+		return nil
+	case driftPolicyAdopt:
+		adoptLiveCluster(state, cluster, pools)
+		reportProgress(ctx, clusterID, "adopted the live configuration")
+	case driftPolicyReconcile:
+		if err := reconcileLiveCluster(ctx, client, clientset, clusterID, state, cluster, pools); err != nil {
+			return fmt.Errorf("failed to reconcile LKE cluster %d: %w", clusterID, err)
+		}
+		reportProgress(ctx, clusterID, "reconciled with its configuration")
+	default:
+		return fmt.Errorf("unknown drift policy %q", policy)
+	}
+
+	delete(info.Metadata, "drift")
+	return storeState(info, *state)
+}
+
+// adoptLiveCluster takes the live values of the drifted fields into the state.
+func adoptLiveCluster(state *state, cluster *raw.LKECluster, pools []raw.LKENodePool) {
+	if state.Label != "" {
+		state.Label = cluster.Label
+	}
+	tags, description := splitDescriptionTag(cluster.Tags)
+	state.Tags = tags
+	// The tag only holds the beginning of a long description, so the stored
+	// description is kept unless the tag was changed
+	if description != descriptionTag(state.Description) {
+		state.Description = strings.TrimPrefix(description, descriptionTagPrefix)
+	}
+	if state.HighAvailability != nil {
+		ha := cluster.ControlPlane.HighAvailability
+		state.HighAvailability = &ha
+	}
+	if len(state.NodePools) > 0 {
+		state.NodePools = livePoolCounts(pools)
+	}
+}
+
+// reconcileLiveCluster changes the live cluster back to the stored state,
+// using the same plan an Update to the stored state would apply.
+func reconcileLiveCluster(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	state *state,
+	cluster *raw.LKECluster,
+	pools []raw.LKENodePool,
+) error {
+	if err := validateHATransition(cluster, *state); err != nil {
+		return err
+	}
+	if updateOpts, changes := computeClusterUpdate(cluster, *state); len(changes) > 0 {
+		if err := updateCluster(ctx, client, clientset, clusterID, updateOpts, state.timeouts()); err != nil {
+			return err
+		}
+	}
+
+	if len(state.NodePools) == 0 {
+		return nil
+	}
+
+	target := make(map[string]int, len(state.NodePools))
+	for t, count := range state.NodePools {
+		target[t] = count
+	}
+	plan := computePoolPlan(pools, target)
+	if err := plan.validate(pools); err != nil {
+		return err
+	}
+
+	applier := &planApplier{
+		client:    client,
+		clientset: clientset,
+		clusterID: clusterID,
+		state:     state,
+		timeouts:  state.timeouts(),
+	}
+	return applier.apply(ctx, plan)
+}
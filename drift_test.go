@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectDrift(t *testing.T) {
+	ha := false
+	stored := state{
+		Label:            "cluster",
+		Tags:             []string{"a", "b"},
+		HighAvailability: &ha,
+		NodePools:        map[string]int{"g6-standard-1": 3, "g6-standard-2": 1},
+	}
+	cluster := &raw.LKECluster{
+		Label: "cluster",
+		Tags:  []string{"b", "a"},
+	}
+	pools := []raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-1", Count: 3},
+		{ID: 2, Type: "g6-standard-2", Count: 1},
+	}
+
+	assert.Empty(t, detectDrift(stored, cluster, pools))
+
+	drifted := &raw.LKECluster{
+		Label:        "renamed",
+		Tags:         []string{"a"},
+		ControlPlane: raw.LKEClusterControlPlane{HighAvailability: true},
+	}
+	driftedPools := []raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-1", Count: 5},
+		{ID: 3, Type: "g6-standard-4", Count: 2},
+	}
+
+	assert.Equal(t, []driftChange{
+		{Field: "label", Stored: "cluster", Live: "renamed"},
+		{Field: "tags", Stored: "[a b]", Live: "[a]"},
+		{Field: "high-availability", Stored: "false", Live: "true"},
+		{Field: "node-pool g6-standard-1", Stored: "3", Live: "5"},
+		{Field: "node-pool g6-standard-2", Stored: "1", Live: "absent"},
+		{Field: "node-pool g6-standard-4", Stored: "absent", Live: "2"},
+	}, detectDrift(stored, drifted, driftedPools))
+
+	adopted := stored
+	adoptLiveCluster(&adopted, drifted, driftedPools)
+	assert.Empty(t, detectDrift(adopted, drifted, driftedPools))
+}
+
+func TestDetectDrift_UnknownFieldsAreIgnored(t *testing.T) {
+	cluster := &raw.LKECluster{
+		Label:        "cluster",
+		ControlPlane: raw.LKEClusterControlPlane{HighAvailability: true},
+	}
+	pools := []raw.LKENodePool{{ID: 1, Type: "g6-standard-1", Count: 3}}
+
+	assert.Empty(t, detectDrift(state{}, cluster, pools))
+}
+
+func TestResizedBySetClusterSize(t *testing.T) {
+	stored := state{NodePools: map[string]int{"g6-standard-1": 5, "g6-standard-2": 1}}
+	pools := func(counts map[string]int) []raw.LKENodePool {
+		var pools []raw.LKENodePool
+		for nodeType, count := range counts {
+			pools = append(pools, raw.LKENodePool{Type: nodeType, Count: count})
+		}
+		return pools
+	}
+
+	assert.True(t, resizedBySetClusterSize(stored, pools(map[string]int{"g6-standard-1": 5, "g6-standard-2": 1})))
+	assert.True(t, resizedBySetClusterSize(stored, pools(map[string]int{"g6-standard-1": 10, "g6-standard-2": 2})))
+	assert.False(t, resizedBySetClusterSize(stored, pools(map[string]int{"g6-standard-1": 3, "g6-standard-2": 3})))
+	assert.False(t, resizedBySetClusterSize(stored, pools(map[string]int{"g6-standard-1": 6})))
+}
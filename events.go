@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// How often the account events are listed while anyone waits on them
+	eventPollInterval = 5 * time.Second
+	// Waits re-check their condition at least this often, since not every
+	// change of a cluster is announced by an event
+	eventFallbackInterval = 30 * time.Second
+	// Each poll lists this many of the most recent events, enough to cover
+	// what happens in an account between two polls
+	eventPageSize = 100
+
+	// linodego has no constant for the entity type of LKE clusters
+	entityLKECluster raw.EntityType = "lkecluster"
+)
+
+var (
+	eventWatchersLock sync.Mutex
+	eventWatchers     = map[*raw.Client]*eventWatcher{}
+)
+
+// eventWatcher lists the account events of a client on behalf of every wait
+// using that client, so that waits only fetch the state of a cluster after
+// something happened to it instead of polling it on their own.
+type eventWatcher struct {
+	client *raw.Client
+
+	lock          sync.Mutex
+	running       bool
+	subscriptions map[*eventSubscription]struct{}
+	// The ID of the newest event seen so far
+	lastID int
+	// The last seen status of the listed events, by event ID
+	seen map[int]raw.EventStatus
+}
+
+// eventSubscription is notified on C about the events matching it.
+type eventSubscription struct {
+	C       chan struct{}
+	match   func(raw.Event) bool
+	watcher *eventWatcher
+}
+
+// watchClusterEvents subscribes to the events of the LKE cluster and of the
+// Linodes backing its nodes. The subscription must be closed.
+func watchClusterEvents(client *raw.Client, clusterID int) *eventSubscription {
+	eventWatchersLock.Lock()
+	watcher, ok := eventWatchers[client]
+	if !ok {
+		watcher = &eventWatcher{
+			client:        client,
+			subscriptions: map[*eventSubscription]struct{}{},
+			seen:          map[int]raw.EventStatus{},
+		}
+		eventWatchers[client] = watcher
+	}
+	eventWatchersLock.Unlock()
+
+	return watcher.subscribe(func(event raw.Event) bool {
+		return clusterEvent(event, clusterID)
+	})
+}
+
+// clusterEvent reports whether the event concerns the cluster or one of its
+// nodes, whose Linodes are labeled lke<cluster id>-<pool id>-<suffix>.
+func clusterEvent(event raw.Event, clusterID int) bool {
+	nodePrefix := fmt.Sprintf("lke%d-", clusterID)
+	for _, entity := range []*raw.EventEntity{event.Entity, event.SecondaryEntity} {
+		if entity == nil {
+			continue
+		}
+		switch entity.Type {
+		case entityLKECluster:
+			if id, ok := entity.ID.(float64); ok && int(id) == clusterID {
+				return true
+			}
+		case raw.EntityLinode:
+			if strings.HasPrefix(entity.Label, nodePrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (w *eventWatcher) subscribe(match func(raw.Event) bool) *eventSubscription {
+	sub := &eventSubscription{
+		C:       make(chan struct{}, 1),
+		match:   match,
+		watcher: w,
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.subscriptions[sub] = struct{}{}
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return sub
+}
+
+// Close ends the subscription. The watcher stops once nobody is subscribed.
+func (s *eventSubscription) Close() {
+	s.watcher.lock.Lock()
+	defer s.watcher.lock.Unlock()
+
+	delete(s.watcher.subscriptions, s)
+}
+
+func (w *eventWatcher) run() {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.lock.Lock()
+		if len(w.subscriptions) == 0 {
+			// Statuses seen now are stale once somebody subscribes again
+			w.seen = map[int]raw.EventStatus{}
+			w.running = false
+			w.lock.Unlock()
+			return
+		}
+		w.lock.Unlock()
+
+		if err := w.poll(); err != nil {
+			logrus.Debugf("failed to list account events: %s", err)
+		}
+	}
+}
+
+// poll lists the most recent events and notifies the subscriptions matching
+// the events that are newer than the last seen one or changed their status.
+func (w *eventWatcher) poll() error {
+	filter, err := json.Marshal(map[string]string{
+		"+order_by": "created",
+		"+order":    "desc",
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventPollInterval)
+	defer cancel()
+
+	// A single page, as listing page 0 would fetch the whole event history
+	opts := raw.NewListOptions(1, string(filter))
+	opts.PageSize = eventPageSize
+	events, err := w.client.ListEvents(ctx, opts)
+	if err != nil {
+		return err
+	}
+	w.notify(events)
+	return nil
+}
+
+// notify notifies the subscriptions matching the events that are newer than
+// the last seen one or changed their status, and remembers the events.
+func (w *eventWatcher) notify(events []raw.Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	seen := make(map[int]raw.EventStatus, len(events))
+	lastID := w.lastID
+	for _, event := range events {
+		seen[event.ID] = event.Status
+		if event.ID > lastID {
+			lastID = event.ID
+		}
+		if status, ok := w.seen[event.ID]; event.ID <= w.lastID && (!ok || status == event.Status) {
+			continue
+		}
+		for sub := range w.subscriptions {
+			if !sub.match(event) {
+				continue
+			}
+			select {
+			case sub.C <- struct{}{}:
+			default:
+				// A notification is pending already
+			}
+		}
+	}
+	w.seen = seen
+	w.lastID = lastID
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    raw.Event
+		expected bool
+	}{
+		{
+			name:     "cluster",
+			event:    raw.Event{Entity: &raw.EventEntity{Type: entityLKECluster, ID: float64(12)}},
+			expected: true,
+		},
+		{
+			name:  "other cluster",
+			event: raw.Event{Entity: &raw.EventEntity{Type: entityLKECluster, ID: float64(123)}},
+		},
+		{
+			name:     "node",
+			event:    raw.Event{Entity: &raw.EventEntity{Type: raw.EntityLinode, ID: float64(5), Label: "lke12-34-5a6b7c8d"}},
+			expected: true,
+		},
+		{
+			name:  "node of other cluster",
+			event: raw.Event{Entity: &raw.EventEntity{Type: raw.EntityLinode, ID: float64(5), Label: "lke123-34-5a6b7c8d"}},
+		},
+		{
+			name: "secondary entity",
+			event: raw.Event{
+				Entity:          &raw.EventEntity{Type: raw.EntityDisk, ID: float64(1)},
+				SecondaryEntity: &raw.EventEntity{Type: raw.EntityLinode, ID: float64(5), Label: "lke12-34-5a6b7c8d"},
+			},
+			expected: true,
+		},
+		{name: "no entity", event: raw.Event{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, clusterEvent(tt.event, 12))
+		})
+	}
+}
+
+func TestWaitForWakesOnEvents(t *testing.T) {
+	events := &eventSubscription{C: make(chan struct{}, 1)}
+	calls := 0
+
+	start := time.Now()
+	err := waitFor(context.Background(), time.Minute, "test", "test", events, func(ctx context.Context) (bool, string, error) {
+		calls++
+		if calls == 1 {
+			events.C <- struct{}{}
+			return false, "not yet", nil
+		}
+		return true, "", nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Less(t, time.Since(start), eventFallbackInterval)
+}
+
+func TestEventWatcherNotify(t *testing.T) {
+	watcher := &eventWatcher{subscriptions: map[*eventSubscription]struct{}{}, seen: map[int]raw.EventStatus{}}
+	sub := &eventSubscription{C: make(chan struct{}, 1), match: func(raw.Event) bool { return true }}
+	watcher.subscriptions[sub] = struct{}{}
+
+	notified := func() bool {
+		select {
+		case <-sub.C:
+			return true
+		default:
+			return false
+		}
+	}
+
+	watcher.notify([]raw.Event{{ID: 2, Status: raw.EventStarted}, {ID: 1, Status: raw.EventFinished}})
+	assert.True(t, notified())
+	assert.Equal(t, 2, watcher.lastID)
+
+	watcher.notify([]raw.Event{{ID: 2, Status: raw.EventStarted}, {ID: 1, Status: raw.EventFinished}})
+	assert.False(t, notified(), "nothing changed")
+
+	watcher.notify([]raw.Event{{ID: 2, Status: raw.EventFinished}, {ID: 1, Status: raw.EventFinished}})
+	assert.True(t, notified(), "status changed")
+
+	watcher.seen = map[int]raw.EventStatus{}
+	watcher.notify([]raw.Event{{ID: 2, Status: raw.EventFinished}})
+	assert.False(t, notified(), "seen before the watcher restarted")
+
+	watcher.notify([]raw.Event{{ID: 3, Status: raw.EventScheduled}, {ID: 2, Status: raw.EventFinished}})
+	assert.True(t, notified())
+	assert.Equal(t, 3, watcher.lastID)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+)
+
+const (
+	// firewallPolicyDefault makes the driver own a firewall allowing the
+	// traffic LKE needs and the NodePorts from the allowed CIDRs
+	firewallPolicyDefault = "default"
+
+	// LKE nodes talk to each other from this range
+	lkeNodeCIDR = "192.168.128.0/17"
+	// NodeBalancers reach the NodePorts from this range
+	nodeBalancerCIDR = "192.168.255.0/24"
+
+	firewallAccept = "ACCEPT"
+	firewallDrop   = "DROP"
+
+	regionCapabilityCloudFirewall = "Cloud Firewall"
+)
+
+func addFirewallFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["firewall-id"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "The ID of an existing Cloud Firewall to attach to every node",
+	}
+	driverFlag.Options["firewall-rules"] = &types.Flag{
+		Type: types.StringType,
+		Usage: "A Cloud Firewall rule set in the JSON format of the Linode API, e.g. " +
+			`{"inbound":[...],"inbound_policy":"DROP","outbound":[],"outbound_policy":"ACCEPT"}. ` +
+			"The driver creates a firewall with these rules for the cluster and attaches it to every node",
+	}
+	driverFlag.Options["firewall-policy"] = &types.Flag{
+		Type: types.StringType,
+		Usage: "Set to default to have the driver create a firewall for the cluster that allows the ports LKE " +
+			"needs and the NodePorts from the allowed CIDRs, and drops all other inbound traffic",
+	}
+	driverFlag.Options["firewall-allowed-cidrs"] = &types.Flag{
+		Type:  types.StringSliceType,
+		Usage: "The CIDRs allowed to reach the NodePorts through the default firewall policy",
+	}
+}
+
+// defaultFirewallRules generates the rules of the default firewall policy.
+// Nodes accept kubelet, Wireguard, BGP and IPIP traffic from each other, and
+// NodePort traffic from NodeBalancers and the allowed CIDRs.
+func defaultFirewallRules(allowedCIDRs []string) (raw.FirewallRuleSet, error) {
+	rule := func(label string, protocol raw.NetworkProtocol, ports string, cidrs ...string) raw.FirewallRule {
+		var ipv4, ipv6 []string
+		for _, cidr := range cidrs {
+			if ip, _, _ := net.ParseCIDR(cidr); ip.To4() == nil {
+				ipv6 = append(ipv6, cidr)
+			} else {
+				ipv4 = append(ipv4, cidr)
+			}
+		}
+		addresses := raw.NetworkAddresses{}
+		if len(ipv4) > 0 {
+			addresses.IPv4 = &ipv4
+		}
+		if len(ipv6) > 0 {
+			addresses.IPv6 = &ipv6
+		}
+		return raw.FirewallRule{
+			Action:    firewallAccept,
+			Label:     label,
+			Protocol:  protocol,
+			Ports:     ports,
+			Addresses: addresses,
+		}
+	}
+
+	for _, cidr := range allowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return raw.FirewallRuleSet{}, fmt.Errorf("invalid allowed CIDR %q: %s", cidr, err)
+		}
+	}
+
+	inbound := []raw.FirewallRule{
+		rule("lke-kubelet", raw.TCP, "10250", lkeNodeCIDR),
+		rule("lke-wireguard", raw.UDP, "51820", lkeNodeCIDR),
+		rule("lke-bgp", raw.TCP, "179", lkeNodeCIDR),
+		rule("lke-ipip", raw.IPENCAP, "", lkeNodeCIDR),
+		rule("lke-nodeports-tcp", raw.TCP, defaultNodePortRange, nodeBalancerCIDR),
+		rule("lke-nodeports-udp", raw.UDP, defaultNodePortRange, nodeBalancerCIDR),
+	}
+	if len(allowedCIDRs) > 0 {
+		inbound = append(inbound,
+			rule("allowed-nodeports-tcp", raw.TCP, defaultNodePortRange, allowedCIDRs...),
+			rule("allowed-nodeports-udp", raw.UDP, defaultNodePortRange, allowedCIDRs...),
+		)
+	}
+
+	return raw.FirewallRuleSet{
+		Inbound:        inbound,
+		InboundPolicy:  firewallDrop,
+		Outbound:       []raw.FirewallRule{},
+		OutboundPolicy: firewallAccept,
+	}, nil
+}
+
+// ownedFirewallRules returns the rules of the firewall the driver is to own
+// for the cluster, and false if it is not to own one.
+func (s *state) ownedFirewallRules() (raw.FirewallRuleSet, bool, error) {
+	switch {
+	case s.FirewallPolicy == firewallPolicyDefault:
+		ruleSet, err := defaultFirewallRules(s.FirewallAllowedCIDRs)
+		return ruleSet, true, err
+	case s.FirewallRules != "":
+		ruleSet, err := parseFirewallRules(s.FirewallRules)
+		return ruleSet, true, err
+	}
+	return raw.FirewallRuleSet{}, false, nil
+}
+
+// firewallRegionCapabilities lists the region capabilities the firewall
+// settings of the state need.
+func (s *state) firewallRegionCapabilities() []string {
+	if s.FirewallID != 0 || s.FirewallRules != "" || s.FirewallPolicy != "" {
+		return []string{regionCapabilityCloudFirewall}
+	}
+	return nil
+}
+
+// firewallLabel names the firewall the driver creates for the cluster, after
+// the lke<cluster id> prefix of its nodes.
+func firewallLabel(clusterID int) string {
+	return fmt.Sprintf("lke%d-firewall", clusterID)
+}
+
+// parseFirewallRules parses the rule set of the firewall-rules option.
+func parseFirewallRules(rules string) (raw.FirewallRuleSet, error) {
+	var ruleSet raw.FirewallRuleSet
+	if err := json.Unmarshal([]byte(rules), &ruleSet); err != nil {
+		return ruleSet, fmt.Errorf("failed to parse firewall rules: %s", err)
+	}
+	if ruleSet.InboundPolicy == "" || ruleSet.OutboundPolicy == "" {
+		return ruleSet, fmt.Errorf("firewall rules must set inbound_policy and outbound_policy")
+	}
+	return ruleSet, nil
+}
+
+// validateFirewall fails if the firewall settings of the state are invalid,
+// so that they are caught before a billable cluster is created: the rules of
+// an owned firewall must parse, and an existing firewall must exist.
+func validateFirewall(ctx context.Context, client *raw.Client, state state) error {
+	_, owned, err := state.ownedFirewallRules()
+	if err != nil || owned || state.FirewallID == 0 {
+		return err
+	}
+
+	if _, err := client.GetFirewall(ctx, state.FirewallID); err != nil {
+		if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound {
+			return fmt.Errorf("firewall %d does not exist", state.FirewallID)
+		}
+		return fmt.Errorf("failed to get firewall %d: %s", state.FirewallID, err)
+	}
+	return nil
+}
+
+// ensureFirewall brings the firewall of the cluster in line with the
+// firewall settings of newState. It creates, updates or deletes the firewall
+// the driver owns, and detaches the nodes from a firewall they no longer
+// use. The resulting firewall is recorded in state. Nodes are attached by
+// attachFirewall.
+func ensureFirewall(ctx context.Context, client *raw.Client, clusterID int, state *state, newState state) error {
+	ruleSet, owned, err := newState.ownedFirewallRules()
+	if err != nil {
+		return err
+	}
+	state.FirewallRules = newState.FirewallRules
+	state.FirewallPolicy = newState.FirewallPolicy
+	state.FirewallAllowedCIDRs = newState.FirewallAllowedCIDRs
+
+	if owned {
+		if state.FirewallOwned {
+			if _, err := client.UpdateFirewallRules(ctx, state.FirewallID, ruleSet); err != nil {
+				return fmt.Errorf("failed to update rules of firewall %d: %s", state.FirewallID, err)
+			}
+			return nil
+		}
+
+		if err := detachFirewall(ctx, client, clusterID, state.FirewallID); err != nil {
+			return err
+		}
+		firewall, err := client.CreateFirewall(ctx, raw.FirewallCreateOptions{
+			Label: firewallLabel(clusterID),
+			Rules: ruleSet,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create firewall for LKE cluster %d: %s", clusterID, err)
+		}
+		reportProgress(ctx, clusterID, "firewall %d created", firewall.ID)
+
+		state.FirewallID = firewall.ID
+		state.FirewallOwned = true
+		return nil
+	}
+
+	if state.FirewallOwned {
+		if err := deleteOwnedFirewall(ctx, client, clusterID, *state); err != nil {
+			return err
+		}
+	} else if state.FirewallID != newState.FirewallID {
+		if err := detachFirewall(ctx, client, clusterID, state.FirewallID); err != nil {
+			return err
+		}
+	}
+
+	state.FirewallID = newState.FirewallID
+	state.FirewallOwned = false
+	return nil
+}
+
+// deleteOwnedFirewall deletes the firewall the driver created for the
+// cluster, if any.
+func deleteOwnedFirewall(ctx context.Context, client *raw.Client, clusterID int, state state) error {
+	if !state.FirewallOwned || state.FirewallID == 0 {
+		return nil
+	}
+
+	err := client.DeleteFirewall(ctx, state.FirewallID)
+	if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete firewall %d: %s", state.FirewallID, err)
+	}
+	reportProgress(ctx, clusterID, "firewall %d deleted", state.FirewallID)
+	return nil
+}
+
+// attachFirewall attaches the firewall to every node of the pools that is
+// not attached yet, such as nodes added by scaling or recycling.
+func attachFirewall(ctx context.Context, client *raw.Client, clusterID int, firewallID int, pools []raw.LKENodePool) error {
+	if firewallID == 0 {
+		return nil
+	}
+
+	devices, err := client.ListFirewallDevices(ctx, firewallID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list devices of firewall %d: %s", firewallID, err)
+	}
+	attached := map[int]bool{}
+	for _, device := range devices {
+		if device.Entity.Type == raw.FirewallDeviceLinode {
+			attached[device.Entity.ID] = true
+		}
+	}
+
+	for _, instanceID := range missingFirewallDevices(pools, attached) {
+		_, err := client.CreateFirewallDevice(ctx, firewallID, raw.FirewallDeviceCreateOptions{
+			ID:   instanceID,
+			Type: raw.FirewallDeviceLinode,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to attach firewall %d to instance %d: %s", firewallID, instanceID, err)
+		}
+		reportProgress(ctx, clusterID, "firewall %d attached to instance %d", firewallID, instanceID)
+	}
+	return nil
+}
+
+// missingFirewallDevices returns the instances of the pools that are not
+// attached. Nodes still being provisioned have no instance yet.
+func missingFirewallDevices(pools []raw.LKENodePool, attached map[int]bool) []int {
+	var missing []int
+	for _, pool := range pools {
+		for _, linode := range pool.Linodes {
+			if linode.InstanceID != 0 && !attached[linode.InstanceID] {
+				missing = append(missing, linode.InstanceID)
+			}
+		}
+	}
+	return missing
+}
+
+// detachFirewall detaches the nodes of the cluster from the firewall.
+func detachFirewall(ctx context.Context, client *raw.Client, clusterID int, firewallID int) error {
+	if firewallID == 0 {
+		return nil
+	}
+
+	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	}
+	nodes := map[int]bool{}
+	for _, pool := range pools {
+		for _, linode := range pool.Linodes {
+			nodes[linode.InstanceID] = true
+		}
+	}
+
+	devices, err := client.ListFirewallDevices(ctx, firewallID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list devices of firewall %d: %s", firewallID, err)
+	}
+	for _, device := range devices {
+		if device.Entity.Type != raw.FirewallDeviceLinode || !nodes[device.Entity.ID] {
+			continue
+		}
+		if err := client.DeleteFirewallDevice(ctx, firewallID, device.ID); err != nil {
+			return fmt.Errorf("failed to detach firewall %d from instance %d: %s", firewallID, device.Entity.ID, err)
+		}
+	}
+	reportProgress(ctx, clusterID, "firewall %d detached", firewallID)
+	return nil
+}
+
+// reconcileFirewall attaches the firewall of the cluster to the nodes that
+// lack it.
+func reconcileFirewall(ctx context.Context, client *raw.Client, clusterID int, state state) error {
+	if state.FirewallID == 0 {
+		return nil
+	}
+
+	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	}
+	return attachFirewall(ctx, client, clusterID, state.FirewallID, pools)
+}
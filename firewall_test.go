@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFirewallRules(t *testing.T) {
+	ruleSet, err := parseFirewallRules(`{
+		"inbound": [{"action": "ACCEPT", "label": "ssh", "ports": "22", "protocol": "TCP", "addresses": {"ipv4": ["192.0.2.0/24"]}}],
+		"inbound_policy": "DROP",
+		"outbound_policy": "ACCEPT"
+	}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP", ruleSet.InboundPolicy)
+	if assert.Len(t, ruleSet.Inbound, 1) {
+		assert.Equal(t, raw.TCP, ruleSet.Inbound[0].Protocol)
+	}
+
+	_, err = parseFirewallRules(`{"inbound_policy": "DROP"}`)
+	assert.Error(t, err)
+	_, err = parseFirewallRules(`not json`)
+	assert.Error(t, err)
+}
+
+func TestMissingFirewallDevices(t *testing.T) {
+	pools := []raw.LKENodePool{
+		{ID: 1, Linodes: []raw.LKENodePoolLinode{{ID: "1-a", InstanceID: 10}, {ID: "1-b", InstanceID: 11}}},
+		// A node still being provisioned has no instance yet
+		{ID: 2, Linodes: []raw.LKENodePoolLinode{{ID: "2-a", InstanceID: 20}, {ID: "2-b"}}},
+	}
+
+	assert.Equal(t, []int{11, 20}, missingFirewallDevices(pools, map[int]bool{10: true}))
+	assert.Empty(t, missingFirewallDevices(pools, map[int]bool{10: true, 11: true, 20: true}))
+}
+
+func TestDefaultFirewallRules(t *testing.T) {
+	ruleSet, err := defaultFirewallRules([]string{"203.0.113.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+	assert.Equal(t, "DROP", ruleSet.InboundPolicy)
+	assert.Equal(t, "ACCEPT", ruleSet.OutboundPolicy)
+
+	rules := map[string]raw.FirewallRule{}
+	for _, rule := range ruleSet.Inbound {
+		rules[rule.Label] = rule
+	}
+	assert.Equal(t, []string{lkeNodeCIDR}, *rules["lke-kubelet"].Addresses.IPv4)
+	assert.Equal(t, raw.IPENCAP, rules["lke-ipip"].Protocol)
+	if assert.Contains(t, rules, "allowed-nodeports-tcp") {
+		allowed := rules["allowed-nodeports-tcp"]
+		assert.Equal(t, "30000-32767", allowed.Ports)
+		assert.Equal(t, []string{"203.0.113.0/24"}, *allowed.Addresses.IPv4)
+		assert.Equal(t, []string{"2001:db8::/32"}, *allowed.Addresses.IPv6)
+	}
+
+	ruleSet, err = defaultFirewallRules(nil)
+	assert.NoError(t, err)
+	assert.Len(t, ruleSet.Inbound, 6)
+
+	_, err = defaultFirewallRules([]string{"203.0.113.0"})
+	assert.Error(t, err)
+}
+
+func TestValidateFirewall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/v4/networking/firewalls/5" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"reason":"Not found"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":5,"label":"nodes","status":"enabled"}`))
+	}))
+	defer server.Close()
+	client := raw.NewClient(server.Client())
+	client.SetBaseURL(server.URL)
+	client.SetRetryCount(0)
+	ctx := context.Background()
+
+	assert.NoError(t, validateFirewall(ctx, &client, state{}))
+	assert.NoError(t, validateFirewall(ctx, &client, state{FirewallID: 5}))
+	assert.EqualError(t, validateFirewall(ctx, &client, state{FirewallID: 6}), "firewall 6 does not exist")
+	assert.Error(t, validateFirewall(ctx, &client, state{FirewallRules: "{}"}))
+	assert.NoError(t, validateFirewall(ctx, &client, state{FirewallID: 6, FirewallPolicy: firewallPolicyDefault}))
+}
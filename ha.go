@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"k8s.io/client-go/kubernetes"
+)
+
+// validateHATransition refuses to disable high availability, which LKE does
+// not support once a control plane was converted.
+func validateHATransition(cluster *raw.LKECluster, newState state) error {
+	if newState.HighAvailability == nil {
+		return nil
+	}
+	if cluster.ControlPlane.HighAvailability && !*newState.HighAvailability {
+		return fmt.Errorf("high availability can not be disabled for LKE cluster %d once it is enabled", cluster.ID)
+	}
+	return nil
+}
+
+// updateCluster applies the cluster level changes and, if the control plane
+// changes, waits for it to finish converting.
+func updateCluster(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	updateOpts raw.LKEClusterUpdateOptions,
+	timeouts waitTimeouts,
+) error {
+	if _, err := client.UpdateLKECluster(ctx, clusterID, updateOpts); err != nil {
+		return fmt.Errorf("failed to update cluster %d: %s", clusterID, err)
+	}
+
+	if updateOpts.ControlPlane == nil {
+		return nil
+	}
+	return waitUntilControlPlaneConverted(ctx, client, clientset, clusterID, updateOpts.ControlPlane.HighAvailability, timeouts.ControlPlane)
+}
+
+// waitUntilControlPlaneConverted waits until the cluster reports the wanted
+// control plane, is ready and serves its API again.
+func waitUntilControlPlaneConverted(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	highAvailability bool,
+	timeout time.Duration,
+) error {
+	what := fmt.Sprintf("the control plane of LKE cluster %d to convert", clusterID)
+	return pollOnClusterEvents(ctx, client, clusterID, timeout, "control-plane-converted", what, func(ctx context.Context) (bool, string, error) {
+		cluster, err := client.GetLKECluster(ctx, clusterID)
+		if err != nil {
+			return false, "", fmt.Errorf("failed to get LKE cluster %d: %s", clusterID, err)
+		}
+		if cluster.ControlPlane.HighAvailability != highAvailability {
+			return false, "control plane is not converted yet", nil
+		}
+		if cluster.Status != raw.LKEClusterReady {
+			return false, fmt.Sprintf("cluster is %s", cluster.Status), nil
+		}
+
+		endpoints, err := client.ListLKEClusterAPIEndpoints(ctx, clusterID, nil)
+		if err != nil {
+			return false, fmt.Sprintf("failed to list API endpoints: %s", err), nil
+		}
+		if len(endpoints) == 0 {
+			return false, "cluster has no API endpoints", nil
+		}
+
+		if clientset != nil {
+			if _, err := clientset.Discovery().ServerVersion(); err != nil {
+				return false, fmt.Sprintf("Kubernetes API is not available: %s", err), nil
+			}
+		}
+		return true, "", nil
+	})
+}
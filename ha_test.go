@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateHATransition(t *testing.T) {
+	enabled, disabled := true, false
+	ha := &raw.LKECluster{ID: 1, ControlPlane: raw.LKEClusterControlPlane{HighAvailability: true}}
+	standard := &raw.LKECluster{ID: 2}
+
+	assert.NoError(t, validateHATransition(standard, state{HighAvailability: &enabled}))
+	assert.NoError(t, validateHATransition(standard, state{HighAvailability: &disabled}))
+	assert.NoError(t, validateHATransition(ha, state{HighAvailability: &enabled}))
+	assert.NoError(t, validateHATransition(ha, state{}))
+	assert.Error(t, validateHATransition(ha, state{HighAvailability: &disabled}))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/kontainer-engine/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// kubeDNSService fronts the CoreDNS pods, which carry its name as label
+	kubeDNSService = "kube-dns"
+	// The ready plugin of CoreDNS reports on this port whether the server
+	// and its plugins, the kubernetes plugin included, can serve queries
+	coreDNSReadyPort = "8181"
+)
+
+func addHealthCheckFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["health-check"] = &types.Flag{
+		Type:  types.BoolType,
+		Usage: "If enabled, create and update wait until every node is Ready, the kube-system workloads are available and every CoreDNS pod reports ready to serve queries",
+	}
+}
+
+// waitUntilClusterHealthy waits until the cluster has the expected number of
+// Ready nodes, every kube-system DaemonSet and Deployment is available, the
+// cluster DNS service has ready endpoints and CoreDNS itself reports ready.
+func waitUntilClusterHealthy(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	clusterID int,
+	expectedNodes int,
+	timeout time.Duration,
+) error {
+	reportProgress(ctx, clusterID, "checking cluster health")
+
+	what := fmt.Sprintf("LKE cluster %d to be healthy", clusterID)
+	err := pollUntil(ctx, timeout, "cluster-healthy", what, func(ctx context.Context) (bool, string, error) {
+		healthy, reason := clusterHealthy(ctx, clientset, expectedNodes)
+		if healthy {
+			healthy, reason = coreDNSReady(ctx, clientset)
+		}
+		return healthy, reason, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	reportProgress(ctx, clusterID, "cluster is healthy")
+	return nil
+}
+
+// clusterHealthy reports whether all nodes are Ready and the kube-system
+// workloads are available. Errors talking to the cluster are treated as not
+// healthy yet.
+func clusterHealthy(ctx context.Context, clientset kubernetes.Interface, expectedNodes int) (bool, string) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Sprintf("failed to list nodes: %s", err)
+	}
+	ready := 0
+	for _, node := range nodes.Items {
+		if nodeReady(node) {
+			ready++
+		}
+	}
+	if len(nodes.Items) != expectedNodes || ready != expectedNodes {
+		return false, fmt.Sprintf("%d of %d nodes are Ready", ready, expectedNodes)
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Sprintf("failed to list DaemonSets: %s", err)
+	}
+	var unavailable []string
+	for _, ds := range daemonSets.Items {
+		// A DaemonSet whose node selector matches no node has nothing to run
+		if ds.Status.NumberAvailable < ds.Status.DesiredNumberScheduled {
+			unavailable = append(unavailable, "DaemonSet "+ds.Name)
+		}
+	}
+
+	deployments, err := clientset.AppsV1().Deployments(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Sprintf("failed to list Deployments: %s", err)
+	}
+	for _, deployment := range deployments.Items {
+		replicas := int32(1)
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+		if deployment.Status.AvailableReplicas < replicas {
+			unavailable = append(unavailable, "Deployment "+deployment.Name)
+		}
+	}
+	if len(unavailable) > 0 {
+		return false, fmt.Sprintf("kube-system %s not available", strings.Join(unavailable, ", "))
+	}
+
+	endpoints, err := clientset.CoreV1().Endpoints(metav1.NamespaceSystem).Get(ctx, kubeDNSService, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Sprintf("failed to get %s endpoints: %s", kubeDNSService, err)
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("%s has no ready endpoints", kubeDNSService)
+}
+
+// coreDNSReady asks every CoreDNS pod, through the API server proxy, whether
+// its ready plugin considers it able to serve queries. Errors talking to the
+// cluster are treated as not ready yet.
+func coreDNSReady(ctx context.Context, clientset kubernetes.Interface) (bool, string) {
+	pods, err := clientset.CoreV1().Pods(metav1.NamespaceSystem).List(ctx, metav1.ListOptions{
+		LabelSelector: "k8s-app=" + kubeDNSService,
+	})
+	if err != nil {
+		return false, fmt.Sprintf("failed to list CoreDNS pods: %s", err)
+	}
+	if len(pods.Items) == 0 {
+		return false, "no CoreDNS pods"
+	}
+
+	for _, pod := range pods.Items {
+		_, err := clientset.CoreV1().RESTClient().Get().
+			Namespace(pod.Namespace).
+			Resource("pods").
+			Name(pod.Name + ":" + coreDNSReadyPort).
+			SubResource("proxy").
+			Suffix("ready").
+			DoRaw(ctx)
+		if err != nil {
+			return false, fmt.Sprintf("CoreDNS pod %s is not ready: %s", pod.Name, err)
+		}
+	}
+	return true, ""
+}
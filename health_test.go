@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func healthyClusterObjects() []runtime.Object {
+	replicas := int32(2)
+	return []runtime.Object{
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "lke1-1-a"},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			}},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "calico-node", Namespace: metav1.NamespaceSystem},
+			Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 1, NumberAvailable: 1},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "gpu-plugin", Namespace: metav1.NamespaceSystem},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "coredns", Namespace: metav1.NamespaceSystem},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     appsv1.DeploymentStatus{AvailableReplicas: 2},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: kubeDNSService, Namespace: metav1.NamespaceSystem},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.2.0.2"}},
+			}},
+		},
+	}
+}
+
+func TestClusterHealthy(t *testing.T) {
+	ctx := context.Background()
+
+	healthy, reason := clusterHealthy(ctx, fake.NewSimpleClientset(healthyClusterObjects()...), 1)
+	assert.True(t, healthy, reason)
+
+	healthy, reason = clusterHealthy(ctx, fake.NewSimpleClientset(healthyClusterObjects()...), 2)
+	assert.False(t, healthy)
+	assert.Equal(t, "1 of 2 nodes are Ready", reason)
+}
+
+func TestClusterHealthy_UnavailableWorkloads(t *testing.T) {
+	ctx := context.Background()
+
+	objects := healthyClusterObjects()
+	objects[3].(*appsv1.Deployment).Status.AvailableReplicas = 1
+	healthy, reason := clusterHealthy(ctx, fake.NewSimpleClientset(objects...), 1)
+	assert.False(t, healthy)
+	assert.Equal(t, "kube-system Deployment coredns not available", reason)
+
+	objects = healthyClusterObjects()
+	objects[4].(*v1.Endpoints).Subsets = nil
+	healthy, reason = clusterHealthy(ctx, fake.NewSimpleClientset(objects...), 1)
+	assert.False(t, healthy)
+	assert.Equal(t, "kube-dns has no ready endpoints", reason)
+}
+
+func TestCoreDNSReady(t *testing.T) {
+	ready := map[string]bool{"coredns-a": true, "coredns-b": false}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/kube-system/pods", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "k8s-app=kube-dns", r.URL.Query().Get("labelSelector"))
+		pods := v1.PodList{}
+		for name := range ready {
+			pods.Items = append(pods.Items, v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceSystem}})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pods)
+	})
+	for name := range ready {
+		name := name
+		mux.HandleFunc("/api/v1/namespaces/kube-system/pods/"+name+":8181/proxy/ready", func(w http.ResponseWriter, r *http.Request) {
+			if !ready[name] {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+
+	healthy, reason := coreDNSReady(context.Background(), clientset)
+	assert.False(t, healthy)
+	assert.Contains(t, reason, "CoreDNS pod coredns-b is not ready")
+
+	ready["coredns-b"] = true
+	healthy, reason = coreDNSReady(context.Background(), clientset)
+	assert.True(t, healthy, reason)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	raw "github.com/linode/linodego"
+)
+
+const maxLabelLength = 32
+
+var (
+	// Labels are made of alphanumerics, hyphens, underscores and periods and
+	// begin and end with an alphanumeric
+	labelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]*[a-zA-Z0-9])?$`)
+	// Separators may not be doubled
+	doubledSeparatorPattern = regexp.MustCompile(`--|__|\.\.`)
+)
+
+// validateLabel checks the label against the Linode rules for LKE cluster
+// labels.
+func validateLabel(label string) error {
+	if len(label) == 0 || len(label) > maxLabelLength {
+		return fmt.Errorf("label %q must be between 1 and %d characters long", label, maxLabelLength)
+	}
+	if !labelPattern.MatchString(label) {
+		return fmt.Errorf("label %q may only contain alphanumerics, hyphens, underscores and periods, and must begin and end with an alphanumeric", label)
+	}
+	if doubledSeparatorPattern.MatchString(label) {
+		return fmt.Errorf("label %q may not contain two hyphens, underscores or periods in a row", label)
+	}
+	return nil
+}
+
+// ensureLabelUnique fails if another LKE cluster of the account already uses
+// the label. clusterID is the cluster being labeled, or zero for a new one.
+func ensureLabelUnique(ctx context.Context, client *raw.Client, label string, clusterID int) error {
+	filter, err := json.Marshal(map[string]string{"label": label})
+	if err != nil {
+		return err
+	}
+
+	clusters, err := client.ListLKEClusters(ctx, raw.NewListOptions(0, string(filter)))
+	if err != nil {
+		return fmt.Errorf("failed to list LKE clusters: %s", err)
+	}
+	for _, cluster := range clusters {
+		if cluster.Label == label && cluster.ID != clusterID {
+			return fmt.Errorf("label %q is already used by LKE cluster %d", label, cluster.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLabel(t *testing.T) {
+	valid := []string{"a", "lke-cluster", "team_a.prod-1", strings.Repeat("a", maxLabelLength)}
+	for _, label := range valid {
+		assert.NoError(t, validateLabel(label), label)
+	}
+
+	invalid := []string{
+		"",
+		strings.Repeat("a", maxLabelLength+1),
+		"-cluster",
+		"cluster.",
+		"my cluster",
+		"cluster/prod",
+		"lke--cluster",
+		"lke__cluster",
+		"lke..cluster",
+	}
+	for _, label := range invalid {
+		assert.Error(t, validateLabel(label), label)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,8 +17,6 @@ import (
 	"github.com/rancher/kontainer-engine/drivers/options"
 	"github.com/rancher/kontainer-engine/types"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
-	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -32,6 +31,9 @@ const (
 // Driver defines the struct of lke driver
 type Driver struct {
 	driverCapabilities types.Capabilities
+
+	// Where snapshots are kept, nil if backups are not configured
+	backups *backupStore
 }
 
 type state struct {
@@ -54,6 +56,50 @@ type state struct {
 	// Whether this is an HA cluster (nullable)
 	HighAvailability *bool
 
+	// How nodes are recycled onto a new Kubernetes version after an upgrade
+	UpgradeStrategy string
+	// The number of nodes recycled at once when upgrading node by node
+	UpgradeMaxSurge int
+
+	// Wait timeouts in seconds, zero means the default
+	CreateTimeout       int
+	PoolReadyTimeout    int
+	RemoveTimeout       int
+	DrainTimeout        int
+	ControlPlaneTimeout int
+	HealthCheckTimeout  int
+
+	// How SetClusterSize spreads nodes across pools
+	ClusterSizeStrategy string
+	// The node type of the pool resized by the scalable-pool strategy
+	ScalablePool string
+
+	// What to do when the live cluster drifted from the stored state
+	DriftPolicy string
+
+	// Whether Create and Update wait for the cluster to be healthy
+	HealthCheck bool
+
+	// How many snapshots to keep, and for how long
+	SnapshotRetentionCount int
+	SnapshotRetentionHours int
+
+	// The Cloud Firewall attached to the nodes, either an existing one or
+	// one the driver created from FirewallRules or FirewallPolicy and owns
+	FirewallID           int
+	FirewallRules        string
+	FirewallPolicy       string
+	FirewallAllowedCIDRs []string
+	FirewallOwned        bool
+
+	// Whether the private IPv4 addresses of the nodes are reported
+	PrivateNetworking bool
+
+	// Whether a failed Update reverts the node pool changes it already made
+	RollbackOnFailure bool
+	// Whether Update only reports the changes it would make
+	DryRun bool `json:"-"`
+
 	// cluster info
 	ClusterInfo types.ClusterInfo
 }
@@ -70,6 +116,14 @@ func NewDriver() types.Driver {
 	driver.driverCapabilities.AddCapability(types.GetClusterSizeCapability)
 	driver.driverCapabilities.AddCapability(types.SetClusterSizeCapability)
 
+	backups, err := backupStoreFromEnv()
+	if err != nil {
+		logrus.Warnf("backups are disabled: %s", err)
+	} else if backups != nil {
+		driver.backups = backups
+		driver.driverCapabilities.AddCapability(types.EtcdBackupCapability)
+	}
+
 	return driver
 }
 
@@ -122,6 +176,15 @@ func (d *Driver) GetDriverCreateOptions(ctx context.Context) (*types.DriverFlags
 		Usage: "If enabled, this cluster will be a high availability cluster",
 	}
 
+	addUpgradeFlags(&driverFlag)
+	addClusterSizeFlags(&driverFlag)
+	addTimeoutFlags(&driverFlag)
+	addDriftFlags(&driverFlag)
+	addHealthCheckFlags(&driverFlag)
+	addSnapshotFlags(&driverFlag)
+	addFirewallFlags(&driverFlag)
+	addNetworkFlags(&driverFlag)
+
 	return &driverFlag, nil
 }
 
@@ -141,6 +204,19 @@ func (d *Driver) GetDriverUpdateOptions(ctx context.Context) (*types.DriverFlags
 		},
 	}
 
+	driverFlag.Options["label"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "the label of the cluster in Linode",
+	}
+	driverFlag.Options["description"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "An optional description of this cluster",
+	}
+
+	driverFlag.Options["kubernetes-version"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "The kubernetes version",
+	}
 	driverFlag.Options["node-pools"] = &types.Flag{
 		Type:  types.StringSliceType,
 		Usage: "The list of node pools created for the cluster",
@@ -151,6 +227,24 @@ func (d *Driver) GetDriverUpdateOptions(ctx context.Context) (*types.DriverFlags
 		Usage: "If enabled, this cluster will be a high availability cluster",
 	}
 
+	driverFlag.Options["rollback-on-failure"] = &types.Flag{
+		Type:  types.BoolType,
+		Usage: "If enabled, node pool changes are reverted when an update fails midway",
+	}
+	driverFlag.Options["dry-run"] = &types.Flag{
+		Type:  types.BoolType,
+		Usage: "If enabled, the update only reports the changes it would make in the cluster metadata",
+	}
+
+	addUpgradeFlags(&driverFlag)
+	addClusterSizeFlags(&driverFlag)
+	addTimeoutFlags(&driverFlag)
+	addDriftFlags(&driverFlag)
+	addHealthCheckFlags(&driverFlag)
+	addSnapshotFlags(&driverFlag)
+	addFirewallFlags(&driverFlag)
+	addNetworkFlags(&driverFlag)
+
 	return &driverFlag, nil
 }
 
@@ -180,6 +274,50 @@ func getStateFromOpts(driverOptions *types.DriverOptions) (state, error) {
 		d.HighAvailability = ha.(*bool)
 	}
 
+	d.UpgradeStrategy = options.GetValueFromDriverOptions(driverOptions, types.StringType, "upgrade-strategy", "upgradeStrategy").(string)
+	if d.UpgradeStrategy == "" {
+		d.UpgradeStrategy = upgradeStrategyNode
+	}
+	d.UpgradeMaxSurge = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "upgrade-max-surge", "upgradeMaxSurge").(int64))
+	if d.UpgradeMaxSurge == 0 {
+		d.UpgradeMaxSurge = 1
+	}
+
+	d.ClusterSizeStrategy = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cluster-size-strategy", "clusterSizeStrategy").(string)
+	if d.ClusterSizeStrategy == "" {
+		d.ClusterSizeStrategy = sizeStrategyProportional
+	}
+	d.ScalablePool = options.GetValueFromDriverOptions(driverOptions, types.StringType, "scalable-pool", "scalablePool").(string)
+
+	d.CreateTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "create-timeout", "createTimeout").(int64))
+	d.PoolReadyTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "pool-ready-timeout", "poolReadyTimeout").(int64))
+	d.RemoveTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "remove-timeout", "removeTimeout").(int64))
+	d.DrainTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "drain-timeout", "drainTimeout").(int64))
+	d.ControlPlaneTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "control-plane-timeout", "controlPlaneTimeout").(int64))
+	d.HealthCheckTimeout = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "health-check-timeout", "healthCheckTimeout").(int64))
+
+	d.DriftPolicy = options.GetValueFromDriverOptions(driverOptions, types.StringType, "drift-policy", "driftPolicy").(string)
+	if d.DriftPolicy == "" {
+		d.DriftPolicy = driftPolicyReport
+	}
+
+	d.HealthCheck = options.GetValueFromDriverOptions(driverOptions, types.BoolType, "health-check", "healthCheck").(bool)
+
+	d.SnapshotRetentionCount = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "snapshot-retention-count", "snapshotRetentionCount").(int64))
+	d.SnapshotRetentionHours = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "snapshot-retention-hours", "snapshotRetentionHours").(int64))
+
+	d.FirewallID = int(options.GetValueFromDriverOptions(driverOptions, types.IntType, "firewall-id", "firewallId").(int64))
+	d.FirewallRules = options.GetValueFromDriverOptions(driverOptions, types.StringType, "firewall-rules", "firewallRules").(string)
+	d.FirewallPolicy = options.GetValueFromDriverOptions(driverOptions, types.StringType, "firewall-policy", "firewallPolicy").(string)
+	if cidrs := options.GetValueFromDriverOptions(driverOptions, types.StringSliceType, "firewall-allowed-cidrs", "firewallAllowedCidrs"); cidrs != nil {
+		d.FirewallAllowedCIDRs = cidrs.(*types.StringSlice).Value
+	}
+
+	d.PrivateNetworking = options.GetValueFromDriverOptions(driverOptions, types.BoolType, "private-networking", "privateNetworking").(bool)
+
+	d.RollbackOnFailure = options.GetValueFromDriverOptions(driverOptions, types.BoolType, "rollback-on-failure", "rollbackOnFailure").(bool)
+	d.DryRun = options.GetValueFromDriverOptions(driverOptions, types.BoolType, "dry-run", "dryRun").(bool)
+
 	d.Tags = []string{}
 	tags := options.GetValueFromDriverOptions(driverOptions, types.StringSliceType, "tags")
 	if tags != nil {
@@ -205,6 +343,11 @@ func getStateFromOpts(driverOptions *types.DriverOptions) (state, error) {
 }
 
 func (s *state) validate() error {
+	if s.Label != "" {
+		if err := validateLabel(s.Label); err != nil {
+			return err
+		}
+	}
 	if len(s.NodePools) == 0 {
 		return fmt.Errorf("at least one NodePool is required")
 	}
@@ -213,6 +356,49 @@ func (s *state) validate() error {
 			return fmt.Errorf("at least 1 node required for NodePool=%s", t)
 		}
 	}
+	switch s.UpgradeStrategy {
+	case upgradeStrategyNone, upgradeStrategyPool, upgradeStrategyNode:
+	default:
+		return fmt.Errorf("unknown upgrade strategy %q", s.UpgradeStrategy)
+	}
+	if s.UpgradeMaxSurge < 1 {
+		return fmt.Errorf("upgrade max surge must be at least 1")
+	}
+	switch s.ClusterSizeStrategy {
+	case sizeStrategyProportional, sizeStrategyLargestPool:
+	case sizeStrategyScalablePool:
+		if _, ok := s.NodePools[s.ScalablePool]; !ok {
+			return fmt.Errorf("scalable pool %q is not one of the node pools", s.ScalablePool)
+		}
+	default:
+		return fmt.Errorf("unknown cluster size strategy %q", s.ClusterSizeStrategy)
+	}
+	switch s.DriftPolicy {
+	case driftPolicyReport, driftPolicyReconcile, driftPolicyAdopt:
+	default:
+		return fmt.Errorf("unknown drift policy %q", s.DriftPolicy)
+	}
+	if s.SnapshotRetentionCount < 0 || s.SnapshotRetentionHours < 0 {
+		return fmt.Errorf("snapshot retention may not be negative")
+	}
+	firewalls := 0
+	for _, set := range []bool{s.FirewallID != 0, s.FirewallRules != "", s.FirewallPolicy != ""} {
+		if set {
+			firewalls++
+		}
+	}
+	if firewalls > 1 {
+		return fmt.Errorf("only one of firewall-id, firewall-rules and firewall-policy may be set")
+	}
+	if s.FirewallPolicy != "" && s.FirewallPolicy != firewallPolicyDefault {
+		return fmt.Errorf("unknown firewall policy %q", s.FirewallPolicy)
+	}
+	if len(s.FirewallAllowedCIDRs) > 0 && s.FirewallPolicy == "" {
+		return fmt.Errorf("firewall-allowed-cidrs requires the default firewall policy")
+	}
+	if _, _, err := s.ownedFirewallRules(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -236,26 +422,88 @@ func (d *Driver) Create(ctx context.Context, opts *types.DriverOptions, _ *types
 		return info, err
 	}
 
+	if state.Label != "" {
+		if err := ensureLabelUnique(ctx, client, state.Label, 0); err != nil {
+			return info, err
+		}
+	}
+	if err := validateRegion(ctx, client, state); err != nil {
+		return info, err
+	}
+	if err := validateFirewall(ctx, client, state); err != nil {
+		return info, err
+	}
+
 	req := d.generateClusterCreateRequest(state)
 	logrus.Debugf("LKE api request: %#v", req)
 
 	cluster, err := client.CreateLKECluster(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create LKE cluster: %s", err)
+		err = fmt.Errorf("failed to create LKE cluster: %s", err)
+		info.CreateError = err.Error()
+		return info, err
 	}
 	info.Metadata["cluster-id"] = strconv.Itoa(cluster.ID)
+	reportProgress(ctx, cluster.ID, "cluster created")
+
+	if err := ensureFirewall(ctx, client, cluster.ID, &state, state); err != nil {
+		info.CreateError = err.Error()
+		return info, err
+	}
+	if err := storeState(info, state); err != nil {
+		return info, err
+	}
+
+	events := watchClusterEvents(client, cluster.ID)
+	defer events.Close()
 
 	err = client.WaitForLKEClusterConditions(ctx, cluster.ID, raw.LKEClusterPollOptions{
 		Retry:          true,
-		TimeoutSeconds: 20 * 60,
-	}, k8scondition.ClusterHasReadyNode)
+		TimeoutSeconds: int(state.timeouts().Create / time.Second),
+	}, withNodeProgress(client, cluster.ID, events, k8scondition.ClusterHasReadyNode))
 	if err != nil {
-		return nil, fmt.Errorf("failed to wait for lke cluster ready node: %s", err)
+		err = fmt.Errorf("failed to wait for lke cluster ready node: %s", err)
+		info.CreateError = err.Error()
+		if _, _, statusErr := refreshClusterStatus(ctx, client, cluster.ID, info); statusErr != nil {
+			logrus.Debugf("failed to get the status of LKE cluster %d: %s", cluster.ID, statusErr)
+		}
+		return info, err
+	}
+	reportProgress(ctx, cluster.ID, "cluster has a ready node")
+
+	if err := reconcileFirewall(ctx, client, cluster.ID, state); err != nil {
+		info.CreateError = err.Error()
+		return info, err
+	}
+
+	if state.HealthCheck {
+		if err := checkNewClusterHealth(ctx, client, cluster.ID, state); err != nil {
+			info.CreateError = err.Error()
+			return info, err
+		}
 	}
 
 	return info, err
 }
 
+// checkNewClusterHealth waits for a new cluster to pass the health check.
+func checkNewClusterHealth(ctx context.Context, client *raw.Client, clusterID int, state state) error {
+	kubeconfig, err := client.GetLKEClusterKubeconfig(ctx, clusterID)
+	if err != nil {
+		return fmt.Errorf("failed to get kubeconfig for LKE cluster %d: %s", clusterID, err)
+	}
+	clientset, err := k8s.BuildClientsetFromConfig(kubeconfig, nil)
+	if err != nil {
+		return err
+	}
+
+	nodes := 0
+	for _, count := range state.NodePools {
+		nodes += count
+	}
+	return waitUntilClusterHealthy(ctx, clientset, clusterID, nodes, state.timeouts().HealthCheck)
+}
+
 func storeState(info *types.ClusterInfo, state state) error {
 	bytes, err := json.Marshal(state)
 	if err != nil {
@@ -291,6 +539,22 @@ func (d *Driver) Update(ctx context.Context, info *types.ClusterInfo, opts *type
 	}
 
 	state.AccessToken = newState.AccessToken
+	state.UpgradeStrategy = newState.UpgradeStrategy
+	state.UpgradeMaxSurge = newState.UpgradeMaxSurge
+	state.ClusterSizeStrategy = newState.ClusterSizeStrategy
+	state.ScalablePool = newState.ScalablePool
+	state.CreateTimeout = newState.CreateTimeout
+	state.PoolReadyTimeout = newState.PoolReadyTimeout
+	state.RemoveTimeout = newState.RemoveTimeout
+	state.DrainTimeout = newState.DrainTimeout
+	state.ControlPlaneTimeout = newState.ControlPlaneTimeout
+	state.HealthCheckTimeout = newState.HealthCheckTimeout
+	state.HealthCheck = newState.HealthCheck
+	state.DriftPolicy = newState.DriftPolicy
+	state.SnapshotRetentionCount = newState.SnapshotRetentionCount
+	state.SnapshotRetentionHours = newState.SnapshotRetentionHours
+	state.PrivateNetworking = newState.PrivateNetworking
+	timeouts := state.timeouts()
 
 	client, err := d.getServiceClient(ctx, state.AccessToken)
 	if err != nil {
@@ -302,95 +566,119 @@ func (d *Driver) Update(ctx context.Context, info *types.ClusterInfo, opts *type
 		return nil, fmt.Errorf("failed to parse cluster id: %s", err)
 	}
 
-	stateHAOk := state.HighAvailability != nil
-	newStateHAOk := newState.HighAvailability != nil
-
-	updateOpts := raw.LKEClusterUpdateOptions{}
-	shouldUpdate := false
-
-	if state.Label != newState.Label {
-		updateOpts.Label = newState.Label
-		shouldUpdate = true
+	cluster, err := client.GetLKECluster(ctx, clusterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get LKE cluster %d: %s", clusterID, err)
 	}
-
-	if !sets.NewString(state.Tags...).Equal(sets.NewString(newState.Tags...)) {
-		updateOpts.Tags = &newState.Tags
-		state.Tags = newState.Tags
-		shouldUpdate = true
+	if err := validateHATransition(cluster, newState); err != nil {
+		return nil, err
 	}
-
-	// We should only update HA under certain conditions
-	if newStateHAOk && (!stateHAOk || *state.HighAvailability != *newState.HighAvailability) {
-		updateOpts.ControlPlane = &raw.LKEClusterControlPlane{
-			HighAvailability: *newState.HighAvailability,
-		}
-		shouldUpdate = true
+	// The region cannot change, but the settings it has to support can
+	regionState := newState
+	regionState.Region = cluster.Region
+	if err := validateRegion(ctx, client, regionState); err != nil {
+		return nil, err
 	}
-
-	if shouldUpdate {
-		_, err = client.UpdateLKECluster(ctx, clusterID, updateOpts)
-		if err != nil {
-			return nil, fmt.Errorf("failed to update cluster %d: %s", clusterID, err)
+	if err := validateFirewall(ctx, client, newState); err != nil {
+		return nil, err
+	}
+	updateOpts, changes := computeClusterUpdate(cluster, newState)
+	if updateOpts.Label != "" {
+		if err := ensureLabelUnique(ctx, client, updateOpts.Label, clusterID); err != nil {
+			return nil, err
 		}
 	}
 
+	// A failed Update stores nothing, so a retry diffs the live pools again
 	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
 	}
+	plan := computePoolPlan(pools, newState.NodePools)
+	if err := plan.validate(pools); err != nil {
+		return nil, err
+	}
 
-	pm := make(map[string]raw.LKENodePool) // type -> pool
-	for _, pool := range pools {
-		if _, found := newState.NodePools[pool.Type]; !found {
-			// delete
-			err = client.DeleteLKENodePool(ctx, clusterID, pool.ID)
-			if err != nil {
-				return nil, fmt.Errorf("failed to delete cluster %s node pool type %s", state.Name, pool.Type)
-			}
-		} else {
-			pm[pool.Type] = pool // id, count
+	if newState.DryRun {
+		if newState.K8sVersion != "" && newState.K8sVersion != cluster.K8sVersion {
+			changes = append(changes, clusterChange{Field: "kubernetes-version", From: cluster.K8sVersion, To: newState.K8sVersion})
 		}
-		delete(state.NodePools, pool.Type)
+		return info, storeDryRunPlan(ctx, info, clusterID, dryRunPlan{Cluster: changes, Pools: plan.pending()})
 	}
+	delete(info.Metadata, "update-plan")
 
-	for t, count := range newState.NodePools {
-		if cur, ok := pm[t]; ok {
-			if cur.Count != count {
-				// update
-				_, err = client.UpdateLKENodePool(ctx, clusterID, cur.ID, raw.LKENodePoolUpdateOptions{
-					Count: count,
-				})
-				if err != nil {
-					return nil, fmt.Errorf("failed to update cluster %s node pool type %s", state.Name, cur.Type)
-				}
-				state.NodePools[t] = count
-			}
-		} else {
-			// create
-			_, err := client.CreateLKENodePool(ctx, clusterID, raw.LKENodePoolCreateOptions{
-				Count: count,
-				Type:  t,
-				// Disks: nil, // not supported?
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failed to create cluster %s node pool type %s", state.Name, cur.Type)
+	clientset, err := getClusterClientset(info)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		if err := updateCluster(ctx, client, clientset, clusterID, updateOpts, timeouts); err != nil {
+			return nil, err
+		}
+	}
+	if newState.Label != "" {
+		state.Label = newState.Label
+	}
+	state.Description = newState.Description
+	state.Tags = newState.Tags
+	if newState.HighAvailability != nil {
+		state.HighAvailability = newState.HighAvailability
+	}
+	if err := ensureFirewall(ctx, client, clusterID, &state, newState); err != nil {
+		return nil, err
+	}
+
+	applier := &planApplier{
+		client:    client,
+		clientset: clientset,
+		clusterID: clusterID,
+		state:     &state,
+		timeouts:  timeouts,
+	}
+	if err := applier.apply(ctx, plan); err != nil {
+		if newState.RollbackOnFailure {
+			if rbErr := applier.rollback(ctx, plan); rbErr != nil {
+				return nil, fmt.Errorf("failed to update cluster %s: %w (rollback also failed: %s)", state.Name, err, rbErr)
 			}
-			state.NodePools[t] = count
 		}
+		return nil, fmt.Errorf("failed to update cluster %s: %w", state.Name, err)
 	}
 
-	pools, err = client.ListLKENodePools(context.Background(), clusterID, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	state.NodePools = newState.NodePools
+
+	if clientset != nil {
+		if err := syncDescription(ctx, clientset, state.Description); err != nil {
+			reportWarning(ctx, clusterID, "failed to record the description: %s", err)
+		}
 	}
-	for _, pool := range pools {
-		err = waitUntilPoolReady(ctx, client, clusterID, pool.ID)
-		if err != nil {
+
+	if newState.K8sVersion != "" && newState.K8sVersion != state.K8sVersion {
+		if err := upgradeCluster(ctx, client, clientset, clusterID, state, newState.K8sVersion); err != nil {
 			return nil, err
 		}
+		state.K8sVersion = newState.K8sVersion
 	}
 
-	return info, storeState(info, state)
+	// Nodes added or recycled by the update lack the firewall
+	if err := reconcileFirewall(ctx, client, clusterID, state); err != nil {
+		return nil, err
+	}
+
+	if err := storeState(info, state); err != nil {
+		return nil, err
+	}
+
+	if state.HealthCheck && clientset != nil {
+		nodes := 0
+		for _, count := range state.NodePools {
+			nodes += count
+		}
+		if err := waitUntilClusterHealthy(ctx, clientset, clusterID, nodes, timeouts.HealthCheck); err != nil {
+			return nil, fmt.Errorf("failed to update cluster %s: %w", state.Name, err)
+		}
+	}
+	return info, nil
 }
 
 func (d *Driver) generateClusterCreateRequest(state state) raw.LKEClusterCreateOptions {
@@ -398,7 +686,7 @@ func (d *Driver) generateClusterCreateRequest(state state) raw.LKEClusterCreateO
 		Label:      state.Label,
 		Region:     state.Region,
 		K8sVersion: state.K8sVersion,
-		Tags:       state.Tags,
+		Tags:       state.clusterTags(),
 	}
 
 	// We should only consider HA if it's defined
@@ -432,25 +720,28 @@ func (d *Driver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types
 		return nil, err
 	}
 
+	client, err := d.getServiceClient(ctx, state.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterID, err := strconv.Atoi(info.Metadata["cluster-id"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cluster id: %s", err)
+	}
+
 	var kubeconfig string
 	if exists(info.Metadata, "KubeConfig") {
 		kubeconfig = info.Metadata["KubeConfig"]
 	} else {
 		// Only load Kubeconfig during first run
-		client, err := d.getServiceClient(ctx, state.AccessToken)
-		if err != nil {
-			return nil, err
-		}
-
-		clusterID, err := strconv.Atoi(info.Metadata["cluster-id"])
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse cluster id: %s", err)
-		}
+		events := watchClusterEvents(client, clusterID)
+		defer events.Close()
 
 		err = client.WaitForLKEClusterConditions(ctx, clusterID, raw.LKEClusterPollOptions{
 			Retry:          true,
-			TimeoutSeconds: 20 * 60,
-		}, k8scondition.ClusterHasReadyNode)
+			TimeoutSeconds: int(state.timeouts().Create / time.Second),
+		}, withNodeProgress(client, clusterID, events, k8scondition.ClusterHasReadyNode))
 		if err != nil {
 			return nil, fmt.Errorf("failed to wait for lke cluster ready node: %s", err)
 		}
@@ -460,6 +751,7 @@ func (d *Driver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types
 			return nil, fmt.Errorf("failed to get kubeconfig for LKE cluster %d: %s", clusterID, err)
 		}
 		kubeconfig = lkeKubeconfig.KubeConfig
+		reportProgress(ctx, clusterID, "kubeconfig fetched")
 	}
 
 	kubeConfigBytes, err := base64.StdEncoding.DecodeString(kubeconfig)
@@ -471,6 +763,45 @@ func (d *Driver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse LKE cluster kubeconfig: %s", err)
 	}
+	info.Metadata["KubeConfig"] = kubeconfig
+
+	clientset, err := getClusterClientset(info)
+	if err != nil {
+		return nil, err
+	}
+	cluster, pools, err := refreshClusterStatus(ctx, client, clusterID, info)
+	if err != nil {
+		// Only acting on drift needs the live cluster, the status and drift
+		// reports can wait for the next check
+		if state.DriftPolicy != "" && state.DriftPolicy != driftPolicyReport {
+			return nil, err
+		}
+		reportWarning(ctx, clusterID, "failed to refresh the cluster status: %s", err)
+	} else if err := checkDrift(ctx, client, clientset, clusterID, info, &state, state.DriftPolicy, cluster, pools); err != nil {
+		return nil, err
+	}
+	if clientset != nil {
+		if err := syncDescription(ctx, clientset, state.Description); err != nil {
+			reportWarning(ctx, clusterID, "failed to record the description: %s", err)
+		}
+	}
+	if cluster != nil {
+		if err := attachFirewall(ctx, client, clusterID, state.FirewallID, pools); err != nil {
+			return nil, err
+		}
+		if state.PrivateNetworking {
+			if err := recordPrivateIPs(ctx, client, pools, info); err != nil {
+				return nil, err
+			}
+		} else {
+			delete(info.Metadata, "node-private-ips")
+		}
+	}
+	if d.backups != nil {
+		if err := recordSnapshots(ctx, d.backups, clusterID, info); err != nil {
+			reportWarning(ctx, clusterID, "failed to list snapshots: %s", err)
+		}
+	}
 
 	info.Version = state.K8sVersion
 	count := 0
@@ -492,12 +823,12 @@ func (d *Driver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types
 		info.ClientKey = base64.StdEncoding.EncodeToString(cfg.KeyData)
 	}
 
-	info.Metadata["KubeConfig"] = kubeconfig
-	serviceAccountToken, err := generateServiceAccountTokenForLKE(kubeconfig)
+	serviceAccountToken, err := generateServiceAccountTokenForLKE(ctx, kubeconfig)
 	if err != nil {
 		return nil, err
 	}
 	info.ServiceAccountToken = serviceAccountToken
+	reportProgress(ctx, clusterID, "service account created")
 	return info, nil
 }
 
@@ -520,39 +851,35 @@ func (d *Driver) Remove(ctx context.Context, info *types.ClusterInfo) error {
 
 	logrus.Debugf("Removing cluster %v from zone %v", state.Name, state.Region)
 
+	// A retried Remove finds the cluster deleted already
 	err = client.DeleteLKECluster(ctx, clusterID)
-	if err != nil {
-		return fmt.Errorf("failed to delete Linode LKE cluster %d: %s", clusterID, err)
-	}
-	_, err = client.WaitForLKEClusterStatus(ctx, clusterID, "not_ready", 10*60)
-	if err != nil {
+	if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("failed to delete Linode LKE cluster %d: %s", clusterID, err)
+	} else {
+		_, err = client.WaitForLKEClusterStatus(ctx, clusterID, "not_ready", int(state.timeouts().Remove/time.Second))
 		if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound {
-			return nil
+			err = nil
 		}
-		return err
 	}
 
-	return nil
+	// The firewall goes either way, so that it does not leak when the cluster
+	// is gone by the time Remove is retried
+	if fwErr := deleteOwnedFirewall(ctx, client, clusterID, state); fwErr != nil {
+		if err != nil {
+			return fmt.Errorf("%s (deleting the firewall also failed: %s)", err, fwErr)
+		}
+		return fwErr
+	}
+	return err
 }
 
 func (d *Driver) getServiceClient(ctx context.Context, token string) (*raw.Client, error) {
-	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	oauthTransport := &oauth2.Transport{
-		Source: tokenSource,
-	}
-
-	oauth2Client := &http.Client{
-		Transport: oauthTransport,
-	}
-	client := raw.NewClient(oauth2Client)
-
-	client.SetUserAgent("kontainer-engine-driver-lke")
-	client.SetBaseURL(DefaultLinodeURL)
-
-	return &client, nil
+	return linodeClient(token, DefaultLinodeURL), nil
 }
 
-func generateServiceAccountTokenForLKE(kubeconfig string) (string, error) {
+func generateServiceAccountTokenForLKE(ctx context.Context, kubeconfig string) (string, error) {
 	result := ""
 
 	clientset, err := k8s.BuildClientsetFromConfig(&raw.LKEClusterKubeconfig{
@@ -562,8 +889,11 @@ func generateServiceAccountTokenForLKE(kubeconfig string) (string, error) {
 		return "", err
 	}
 
-	err = wait.Poll(retryInterval, serviceAccountRetryTimeout, func() (done bool, err error) {
-		token, err := generateServiceAccountToken(clientset)
+	ctx, cancel := context.WithTimeout(ctx, serviceAccountRetryTimeout)
+	defer cancel()
+
+	err = wait.PollUntil(retryInterval, func() (done bool, err error) {
+		token, err := generateServiceAccountToken(ctx, clientset)
 		if err != nil {
 			logrus.Debugf("retrying on service account generation error: %s", err)
 			return false, nil
@@ -571,7 +901,7 @@ func generateServiceAccountTokenForLKE(kubeconfig string) (string, error) {
 
 		result = token
 		return true, nil
-	})
+	}, ctx.Done())
 
 	return result, err
 }
@@ -592,6 +922,8 @@ func (d *Driver) GetClusterSize(ctx context.Context, info *types.ClusterInfo) (*
 		return nil, err
 	}
 
+	// The metadata written here would not be persisted, so the status and
+	// drift of the cluster are left to PostCheck
 	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
@@ -627,6 +959,10 @@ func (d *Driver) GetVersion(ctx context.Context, info *types.ClusterInfo) (*type
 	return &types.KubernetesVersion{Version: cluster.K8sVersion}, nil
 }
 
+// SetClusterSize resizes the pools of the cluster so that they add up to the
+// requested count. The RPC returns no cluster info, so the new pool sizes
+// cannot be stored in the state; whatever reads the pool sizes of the state
+// afterwards has to allow for the live pools having been resized.
 func (d *Driver) SetClusterSize(ctx context.Context, info *types.ClusterInfo, count *types.NodeCount) error {
 	state, err := getState(info)
 	if err != nil {
@@ -643,85 +979,183 @@ func (d *Driver) SetClusterSize(ctx context.Context, info *types.ClusterInfo, co
 		return err
 	}
 
-	logrus.Info("updating cluster size")
+	reportProgress(ctx, clusterID, "resizing cluster to %d nodes", count.Count)
 
 	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
 	if err != nil {
 		return fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
 	}
 
-	poolID := pools[0].ID
-	poolNodeCount := pools[0].Count
+	counts, err := distributeNodeCount(pools, int(count.Count), state.ClusterSizeStrategy, state.ScalablePool)
+	if err != nil {
+		return fmt.Errorf("failed to resize LKE cluster %d: %w", clusterID, err)
+	}
 
-	_, err = client.UpdateLKENodePool(ctx, clusterID, poolID, raw.LKENodePoolUpdateOptions{
-		Count: int(count.Count),
-	})
+	clientset, err := getClusterClientset(info)
 	if err != nil {
-		return fmt.Errorf(
-			"failed to update LKE Cluster %d Node Pool %d: %w",
-			clusterID,
-			poolID,
-			err,
-		)
+		return err
 	}
 
-	if poolNodeCount < int(count.Count) {
-		err = waitUntilPoolReady(ctx, client, clusterID, poolID)
-		if err != nil {
-			return err
-		}
+	if err := resizePools(ctx, client, clientset, clusterID, pools, counts, state.timeouts()); err != nil {
+		return err
 	}
 
-	logrus.Info("cluster size updated successfully")
+	reportProgress(ctx, clusterID, "cluster resized to %d nodes", count.Count)
 
-	return nil
-}
-
-func waitUntilPoolReady(ctx context.Context, client *raw.Client, clusterID int, poolID int) error {
-	return wait.PollImmediateInfinite(retryInterval, func() (done bool, err error) {
-		pool, err := client.GetLKENodePool(ctx, clusterID, poolID)
-		if err != nil {
-			return false, err
-		}
-		for _, linode := range pool.Linodes {
-			if linode.Status != raw.LKELinodeReady {
-				return false, nil
-			}
-		}
-		return true, nil
-	})
+	return reconcileFirewall(ctx, client, clusterID, state)
 }
 
 func (d *Driver) SetVersion(ctx context.Context, info *types.ClusterInfo, version *types.KubernetesVersion) error {
-	return nil
+	state, err := getState(info)
+	if err != nil {
+		return err
+	}
+
+	clusterID, err := strconv.Atoi(info.Metadata["cluster-id"])
+	if err != nil {
+		return fmt.Errorf("failed to parse cluster id: %s", err)
+	}
+
+	client, err := d.getServiceClient(ctx, state.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	clientset, err := getClusterClientset(info)
+	if err != nil {
+		return err
+	}
+
+	if err := upgradeCluster(ctx, client, clientset, clusterID, state, version.Version); err != nil {
+		return err
+	}
+	// The RPC returns no cluster info to store the version in, so a later
+	// Update may upgrade again, which upgradeCluster turns into a no-op
+	return reconcileFirewall(ctx, client, clusterID, state)
 }
 
 func (d *Driver) GetCapabilities(ctx context.Context) (*types.Capabilities, error) {
 	return &d.driverCapabilities, nil
 }
 
+// ETCDSave exports the resources of the cluster into a snapshot. LKE gives no
+// access to etcd, so this is a logical backup through the Kubernetes API.
 func (d *Driver) ETCDSave(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
-	return fmt.Errorf("ETCD backup operations are not implemented")
+	if d.backups == nil {
+		return errBackupsNotConfigured
+	}
+
+	state, err := getState(clusterInfo)
+	if err != nil {
+		return err
+	}
+	clusterID, err := strconv.Atoi(clusterInfo.Metadata["cluster-id"])
+	if err != nil {
+		return err
+	}
+	config, err := clusterRESTConfig(clusterInfo)
+	if err != nil {
+		return err
+	}
+
+	client, err := d.getServiceClient(ctx, state.AccessToken)
+	if err != nil {
+		return err
+	}
+	cluster, pools, err := fetchCluster(ctx, client, clusterID)
+	if err != nil {
+		return err
+	}
+
+	reportProgress(ctx, clusterID, "saving snapshot %s", snapshotName)
+
+	// Stream the tarball into the bucket as it is written
+	manifest := newSnapshotManifest(cluster, pools)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(exportResources(ctx, config, manifest, writer))
+	}()
+	err = d.backups.put(ctx, clusterID, snapshotName, reader)
+	// Unblock the export if the upload failed
+	reader.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	reportProgress(ctx, clusterID, "saved snapshot %s", snapshotName)
+	return d.backups.applyRetention(ctx, clusterID, state, snapshotName)
 }
 
+// ETCDRestore creates the resources of the snapshot that are missing from the
+// cluster.
 func (d *Driver) ETCDRestore(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) (*types.ClusterInfo, error) {
-	return nil, fmt.Errorf("ETCD backup operations are not implemented")
+	if d.backups == nil {
+		return nil, errBackupsNotConfigured
+	}
+
+	state, err := getState(clusterInfo)
+	if err != nil {
+		return nil, err
+	}
+	clusterID, err := strconv.Atoi(clusterInfo.Metadata["cluster-id"])
+	if err != nil {
+		return nil, err
+	}
+	config, err := clusterRESTConfig(clusterInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := d.getServiceClient(ctx, state.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	cluster, pools, err := fetchCluster(ctx, client, clusterID)
+	if err != nil {
+		return nil, err
+	}
+
+	reportProgress(ctx, clusterID, "restoring snapshot %s", snapshotName)
+
+	snapshot, err := d.backups.get(ctx, clusterID, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	resources, err := readSnapshot(snapshot, func(manifest *snapshotManifest) error {
+		return manifest.checkRestorable(cluster, pools)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore snapshot %s: %w", snapshotName, err)
+	}
+	if err := restoreResources(ctx, config, resources); err != nil {
+		return nil, fmt.Errorf("failed to restore snapshot %s: %w", snapshotName, err)
+	}
+
+	reportProgress(ctx, clusterID, "restored snapshot %s", snapshotName)
+	return clusterInfo, nil
 }
 
+// ETCDRemoveSnapshot deletes the snapshot from the object storage.
 func (d *Driver) ETCDRemoveSnapshot(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
-	return fmt.Errorf("ETCD backup operations are not implemented")
+	if d.backups == nil {
+		return errBackupsNotConfigured
+	}
+
+	clusterID, err := strconv.Atoi(clusterInfo.Metadata["cluster-id"])
+	if err != nil {
+		return err
+	}
+	if err := d.backups.remove(ctx, clusterID, snapshotName); err != nil {
+		return err
+	}
+	reportProgress(ctx, clusterID, "deleted snapshot %s", snapshotName)
+	return nil
 }
 
 func (d *Driver) GetK8SCapabilities(ctx context.Context, options *types.DriverOptions) (*types.K8SCapabilities, error) {
-	capabilities := &types.K8SCapabilities{
-		L4LoadBalancer: &types.LoadBalancerCapabilities{
-			Enabled:              true,
-			Provider:             "NodeBalancer", // what are the options?
-			ProtocolsSupported:   []string{"TCP", "UDP"},
-			HealthCheckSupported: true,
-		},
-	}
-	return capabilities, nil
+	return d.k8sCapabilities(ctx, options), nil
 }
 
 func (d *Driver) RemoveLegacyServiceAccount(ctx context.Context, info *types.ClusterInfo) error {
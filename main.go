@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/rancher/kontainer-engine/types"
 	"github.com/sirupsen/logrus"
@@ -20,10 +23,27 @@ func main() {
 		panic(fmt.Errorf("argument not parsable as int: %v", err))
 	}
 
+	if metricsAddr := os.Getenv(metricsAddrEnv); metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
 	addr := make(chan string)
-	go types.NewServer(&Driver{}, addr).ServeOrDie(fmt.Sprintf("127.0.0.1:%v", port))
+	go types.NewServer(&instrumentedDriver{Driver: NewDriver()}, addr).ServeOrDie(fmt.Sprintf("127.0.0.1:%v", port))
 
 	logrus.Infof("lke driver 2 up and running on at %v", <-addr)
 
-	select {} // wait forever, we only exit if killed by parent process
+	// wait forever, we only exit if killed by parent process
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	// flush the spans of the requests that finished
+	if err := shutdownTracing(context.Background()); err != nil {
+		logrus.Warnf("failed to shut down tracing: %s", err)
+	}
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/sirupsen/logrus"
+)
+
+// metricsAddrEnv is the environment variable holding the address of the
+// metrics listener, metrics are not served if it is unset
+const metricsAddrEnv = "LKE_DRIVER_METRICS_ADDR"
+
+const metricsNamespace = "lke_driver"
+
+var (
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "linode_api_requests_total",
+		Help:      "Linode API requests by method, endpoint and status code.",
+	}, []string{"method", "endpoint", "code"})
+
+	apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "linode_api_request_duration_seconds",
+		Help:      "Duration of Linode API requests by method and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	apiRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "linode_api_retries_total",
+		Help:      "Retried Linode API requests by method and endpoint.",
+	}, []string{"method", "endpoint"})
+
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of driver RPCs by method and result.",
+		// Provisioning takes minutes, so the buckets reach up to an hour
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"method", "result"})
+
+	rpcInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_in_flight",
+		Help:      "Driver RPCs currently in progress by method.",
+	}, []string{"method"})
+
+	waitIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "wait_iterations_total",
+		Help:      "Iterations of wait loops by the condition waited for.",
+	}, []string{"wait"})
+)
+
+// serveMetrics serves the Prometheus metrics of the driver at /metrics.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logrus.Infof("serving metrics at %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("failed to serve metrics: %s", err)
+	}
+}
+
+// Path segments that are IDs of clusters, pools, nodes and the like
+var idSegmentPattern = regexp.MustCompile(`^[0-9]+(-[0-9a-f]+)?$`)
+
+// apiEndpoint returns the path of a Linode API URL with the API version
+// removed and IDs replaced, so that it can be used as a metric label.
+func apiEndpoint(rawURL string) string {
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 0 && strings.HasPrefix(segments[0], "v4") {
+		segments = segments[1:]
+	}
+	for i, segment := range segments {
+		if idSegmentPattern.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// instrumentedTransport records the Linode API requests it sends.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := apiEndpoint(req.URL.Path)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(req.Method, endpoint, code).Inc()
+	apiRequestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// countRetries counts the retried requests of the client.
+func countRetries(client *raw.Client) {
+	client.OnBeforeRequest(func(req *raw.Request) error {
+		if req.Attempt > 1 {
+			apiRetries.WithLabelValues(req.Method, apiEndpoint(req.URL)).Inc()
+		}
+		return nil
+	})
+}
+
+// observeRPC starts timing and tracing a driver RPC. The returned function
+// ends it.
+func observeRPC(ctx context.Context, method string) (context.Context, func(err error)) {
+	rpcInFlight.WithLabelValues(method).Inc()
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "lke."+method)
+
+	return ctx, func(err error) {
+		rpcInFlight.WithLabelValues(method).Dec()
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		rpcDuration.WithLabelValues(method, result).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}
+}
+
+// instrumentedDriver records the duration and the number of in-flight calls
+// of the driver RPCs, and traces them.
+type instrumentedDriver struct {
+	types.Driver
+}
+
+func (d *instrumentedDriver) Create(ctx context.Context, opts *types.DriverOptions, info *types.ClusterInfo) (*types.ClusterInfo, error) {
+	ctx, done := observeRPC(ctx, "Create")
+	info, err := d.Driver.Create(ctx, opts, info)
+	done(err)
+	return info, err
+}
+
+func (d *instrumentedDriver) Update(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions) (*types.ClusterInfo, error) {
+	ctx, done := observeRPC(ctx, "Update")
+	info, err := d.Driver.Update(ctx, info, opts)
+	done(err)
+	return info, err
+}
+
+func (d *instrumentedDriver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types.ClusterInfo, error) {
+	ctx, done := observeRPC(ctx, "PostCheck")
+	info, err := d.Driver.PostCheck(ctx, info)
+	done(err)
+	return info, err
+}
+
+func (d *instrumentedDriver) Remove(ctx context.Context, info *types.ClusterInfo) error {
+	ctx, done := observeRPC(ctx, "Remove")
+	err := d.Driver.Remove(ctx, info)
+	done(err)
+	return err
+}
+
+func (d *instrumentedDriver) GetVersion(ctx context.Context, info *types.ClusterInfo) (*types.KubernetesVersion, error) {
+	ctx, done := observeRPC(ctx, "GetVersion")
+	version, err := d.Driver.GetVersion(ctx, info)
+	done(err)
+	return version, err
+}
+
+func (d *instrumentedDriver) SetVersion(ctx context.Context, info *types.ClusterInfo, version *types.KubernetesVersion) error {
+	ctx, done := observeRPC(ctx, "SetVersion")
+	err := d.Driver.SetVersion(ctx, info, version)
+	done(err)
+	return err
+}
+
+func (d *instrumentedDriver) GetClusterSize(ctx context.Context, info *types.ClusterInfo) (*types.NodeCount, error) {
+	ctx, done := observeRPC(ctx, "GetClusterSize")
+	count, err := d.Driver.GetClusterSize(ctx, info)
+	done(err)
+	return count, err
+}
+
+func (d *instrumentedDriver) SetClusterSize(ctx context.Context, info *types.ClusterInfo, count *types.NodeCount) error {
+	ctx, done := observeRPC(ctx, "SetClusterSize")
+	err := d.Driver.SetClusterSize(ctx, info, count)
+	done(err)
+	return err
+}
+
+func (d *instrumentedDriver) ETCDSave(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
+	ctx, done := observeRPC(ctx, "ETCDSave")
+	err := d.Driver.ETCDSave(ctx, info, opts, snapshotName)
+	done(err)
+	return err
+}
+
+func (d *instrumentedDriver) ETCDRestore(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) (*types.ClusterInfo, error) {
+	ctx, done := observeRPC(ctx, "ETCDRestore")
+	info, err := d.Driver.ETCDRestore(ctx, info, opts, snapshotName)
+	done(err)
+	return info, err
+}
+
+func (d *instrumentedDriver) ETCDRemoveSnapshot(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
+	ctx, done := observeRPC(ctx, "ETCDRemoveSnapshot")
+	err := d.Driver.ETCDRemoveSnapshot(ctx, info, opts, snapshotName)
+	done(err)
+	return err
+}
+
+func (d *instrumentedDriver) GetK8SCapabilities(ctx context.Context, opts *types.DriverOptions) (*types.K8SCapabilities, error) {
+	ctx, done := observeRPC(ctx, "GetK8SCapabilities")
+	capabilities, err := d.Driver.GetK8SCapabilities(ctx, opts)
+	done(err)
+	return capabilities, err
+}
+
+func (d *instrumentedDriver) RemoveLegacyServiceAccount(ctx context.Context, info *types.ClusterInfo) error {
+	ctx, done := observeRPC(ctx, "RemoveLegacyServiceAccount")
+	err := d.Driver.RemoveLegacyServiceAccount(ctx, info)
+	done(err)
+	return err
+}
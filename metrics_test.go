@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/v4/lke/clusters":                                   "lke/clusters",
+		"/v4/lke/clusters/1234/pools/56":                     "lke/clusters/:id/pools/:id",
+		"/v4beta/lke/clusters/1234/nodes/56-abc123":          "lke/clusters/:id/nodes/:id",
+		"https://api.linode.com/v4/linode/instances/789/ips": "linode/instances/:id/ips",
+		"lke/clusters/1234/kubeconfig":                       "lke/clusters/:id/kubeconfig",
+	}
+
+	for rawURL, expected := range tests {
+		assert.Equal(t, expected, apiEndpoint(rawURL), rawURL)
+	}
+}
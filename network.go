@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+)
+
+// Region capabilities as listed by the Linode API
+const regionCapabilityKubernetes = "Kubernetes"
+
+func addNetworkFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["private-networking"] = &types.Flag{
+		Type: types.BoolType,
+		Usage: "If enabled, the private IPv4 addresses LKE gives every node within " + lkeNodeCIDR + " are reported " +
+			"in the cluster metadata. The LKE API and linodego offer no way to put the nodes in a VPC or VLAN, so " +
+			"neither can be selected",
+	}
+}
+
+// requiredRegionCapabilities lists the capabilities the region of the
+// cluster must have for the settings of the state.
+func (s *state) requiredRegionCapabilities() []string {
+	required := []string{regionCapabilityKubernetes}
+	return append(required, s.firewallRegionCapabilities()...)
+}
+
+// validateRegion fails if the region of the cluster lacks a capability the
+// settings of the state need.
+func validateRegion(ctx context.Context, client *raw.Client, state state) error {
+	region, err := client.GetRegion(ctx, state.Region)
+	if err != nil {
+		return fmt.Errorf("failed to get region %s: %s", state.Region, err)
+	}
+	if missing := missingCapabilities(region.Capabilities, state.requiredRegionCapabilities()); len(missing) > 0 {
+		return fmt.Errorf("region %s does not support %s", state.Region, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func missingCapabilities(capabilities []string, required []string) []string {
+	available := map[string]bool{}
+	for _, capability := range capabilities {
+		available[strings.ToLower(capability)] = true
+	}
+
+	var missing []string
+	for _, capability := range required {
+		if !available[strings.ToLower(capability)] {
+			missing = append(missing, capability)
+		}
+	}
+	return missing
+}
+
+// nodePrivateIPs returns the private IPv4 addresses of the nodes of the pools
+// by LKE node ID. Nodes still being provisioned have no instance yet and are
+// left out.
+func nodePrivateIPs(ctx context.Context, client *raw.Client, pools []raw.LKENodePool) (map[string][]string, error) {
+	privateIPs := map[string][]string{}
+	for _, pool := range pools {
+		for _, linode := range pool.Linodes {
+			if linode.InstanceID == 0 {
+				continue
+			}
+
+			ips, err := client.GetInstanceIPAddresses(ctx, linode.InstanceID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get IP addresses of instance %d: %s", linode.InstanceID, err)
+			}
+			privateIPs[linode.ID] = privateAddresses(ips)
+		}
+	}
+	return privateIPs, nil
+}
+
+func privateAddresses(ips *raw.InstanceIPAddressResponse) []string {
+	if ips == nil || ips.IPv4 == nil {
+		return nil
+	}
+
+	var addresses []string
+	for _, ip := range ips.IPv4.Private {
+		addresses = append(addresses, ip.Address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// recordPrivateIPs records the private IPv4 addresses of the nodes of the
+// pools in the metadata of the cluster.
+func recordPrivateIPs(ctx context.Context, client *raw.Client, pools []raw.LKENodePool, info *types.ClusterInfo) error {
+	privateIPs, err := nodePrivateIPs(ctx, client, pools)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(privateIPs)
+	if err != nil {
+		return err
+	}
+	info.Metadata["node-private-ips"] = string(data)
+	return nil
+}
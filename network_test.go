@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingCapabilities(t *testing.T) {
+	capabilities := []string{"Linodes", "Kubernetes", "Cloud Firewall"}
+
+	assert.Empty(t, missingCapabilities(capabilities, (&state{FirewallPolicy: firewallPolicyDefault}).requiredRegionCapabilities()))
+	assert.Empty(t, missingCapabilities([]string{"kubernetes"}, (&state{}).requiredRegionCapabilities()))
+	assert.Equal(t, []string{"Cloud Firewall"},
+		missingCapabilities([]string{"Kubernetes"}, (&state{FirewallID: 1}).requiredRegionCapabilities()))
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	ips := &raw.InstanceIPAddressResponse{
+		IPv4: &raw.InstanceIPv4Response{
+			Public:  []*raw.InstanceIP{{Address: "203.0.113.5"}},
+			Private: []*raw.InstanceIP{{Address: "192.168.140.7"}, {Address: "192.168.133.2"}},
+		},
+	}
+
+	assert.Equal(t, []string{"192.168.133.2", "192.168.140.7"}, privateAddresses(ips))
+	assert.Empty(t, privateAddresses(&raw.InstanceIPAddressResponse{}))
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+type planAction string
+
+const (
+	actionCreatePool planAction = "create-pool"
+	actionResizePool planAction = "resize-pool"
+	actionDeletePool planAction = "delete-pool"
+)
+
+// clusterChange is a cluster level change of an update plan
+type clusterChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+func (c clusterChange) String() string {
+	return fmt.Sprintf("~ %s: %s -> %s", c.Field, c.From, c.To)
+}
+
+// computeClusterUpdate diffs the live cluster against the new state and
+// returns the options that bring the cluster in line with it.
+func computeClusterUpdate(cluster *raw.LKECluster, newState state) (raw.LKEClusterUpdateOptions, []clusterChange) {
+	updateOpts := raw.LKEClusterUpdateOptions{}
+	var changes []clusterChange
+
+	if newState.Label != "" && cluster.Label != newState.Label {
+		updateOpts.Label = newState.Label
+		changes = append(changes, clusterChange{Field: "label", From: cluster.Label, To: newState.Label})
+	}
+
+	if tags := newState.clusterTags(); !sets.NewString(cluster.Tags...).Equal(sets.NewString(tags...)) {
+		updateOpts.Tags = &tags
+		changes = append(changes, clusterChange{
+			Field: "tags",
+			From:  fmt.Sprint(sets.NewString(cluster.Tags...).List()),
+			To:    fmt.Sprint(sets.NewString(tags...).List()),
+		})
+	}
+
+	// We should only update HA under certain conditions
+	if newState.HighAvailability != nil && cluster.ControlPlane.HighAvailability != *newState.HighAvailability {
+		updateOpts.ControlPlane = &raw.LKEClusterControlPlane{
+			HighAvailability: *newState.HighAvailability,
+		}
+		changes = append(changes, clusterChange{
+			Field: "high-availability",
+			From:  strconv.FormatBool(cluster.ControlPlane.HighAvailability),
+			To:    strconv.FormatBool(*newState.HighAvailability),
+		})
+	}
+
+	return updateOpts, changes
+}
+
+// dryRunPlan is what an Update would change, reported by a dry run
+type dryRunPlan struct {
+	Cluster []clusterChange
+	Pools   []planStep
+}
+
+// storeDryRunPlan records the plan in the cluster info metadata and logs it
+// as a readable diff.
+func storeDryRunPlan(ctx context.Context, info *types.ClusterInfo, clusterID int, plan dryRunPlan) error {
+	bytes, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	info.Metadata["update-plan"] = string(bytes)
+
+	reportProgress(ctx, clusterID, "dry run of update:\n%s", plan)
+	return nil
+}
+
+func (p dryRunPlan) String() string {
+	var lines []string
+	for _, change := range p.Cluster {
+		lines = append(lines, change.String())
+	}
+	for _, step := range p.Pools {
+		prefix := "~"
+		switch step.Action {
+		case actionCreatePool:
+			prefix = "+"
+		case actionDeletePool:
+			prefix = "-"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", prefix, step))
+	}
+	if len(lines) == 0 {
+		return "no changes"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// planStep is a single node pool change of an update plan
+type planStep struct {
+	Action planAction
+	Type   string
+	PoolID int
+	// The node count of the pool before and after the step
+	From int
+	To   int
+	Done bool
+	// Whether applying the step began, so that a failed step is undone too
+	Started bool `json:"-"`
+}
+
+func (s planStep) String() string {
+	switch s.Action {
+	case actionCreatePool:
+		return fmt.Sprintf("create pool %s with %d nodes", s.Type, s.To)
+	case actionResizePool:
+		return fmt.Sprintf("resize pool %d (%s) from %d to %d nodes", s.PoolID, s.Type, s.From, s.To)
+	case actionDeletePool:
+		return fmt.Sprintf("delete pool %d (%s) with %d nodes", s.PoolID, s.Type, s.From)
+	}
+	return string(s.Action)
+}
+
+// updatePlan lists the node pool changes of an Update. The plan is not
+// stored: kontainer-engine drops the cluster info of a failed Update, so a
+// retried Update computes a new plan from the live pools instead.
+type updatePlan struct {
+	Steps []planStep
+}
+
+// computePoolPlan diffs the live node pools against the target node pools.
+// New capacity is added before any is taken away: pools are created first,
+// then grown, then shrunk, and pools that are no longer wanted are deleted
+// last.
+func computePoolPlan(pools []raw.LKENodePool, target map[string]int) *updatePlan {
+	plan := &updatePlan{}
+
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+
+	current := map[string]raw.LKENodePool{}
+	var deletes []planStep
+	for _, pool := range pools {
+		if _, found := target[pool.Type]; !found {
+			deletes = append(deletes, planStep{
+				Action: actionDeletePool,
+				Type:   pool.Type,
+				PoolID: pool.ID,
+				From:   pool.Count,
+			})
+			continue
+		}
+		current[pool.Type] = pool
+	}
+
+	nodeTypes := make([]string, 0, len(target))
+	for t := range target {
+		nodeTypes = append(nodeTypes, t)
+	}
+	sort.Strings(nodeTypes)
+
+	var creates, grows, shrinks []planStep
+	for _, t := range nodeTypes {
+		pool, found := current[t]
+		step := planStep{
+			Action: actionResizePool,
+			Type:   t,
+			PoolID: pool.ID,
+			From:   pool.Count,
+			To:     target[t],
+		}
+		switch {
+		case !found:
+			creates = append(creates, planStep{
+				Action: actionCreatePool,
+				Type:   t,
+				To:     target[t],
+			})
+		case pool.Count < target[t]:
+			grows = append(grows, step)
+		case pool.Count > target[t]:
+			shrinks = append(shrinks, step)
+		}
+	}
+
+	plan.Steps = append(plan.Steps, creates...)
+	plan.Steps = append(plan.Steps, grows...)
+	plan.Steps = append(plan.Steps, shrinks...)
+	plan.Steps = append(plan.Steps, deletes...)
+
+	return plan
+}
+
+// validate refuses plans that would leave the cluster without any nodes at
+// some point while they are applied.
+func (p *updatePlan) validate(pools []raw.LKENodePool) error {
+	nodes := 0
+	for _, pool := range pools {
+		nodes += pool.Count
+	}
+	for _, step := range p.Steps {
+		if step.Done {
+			continue
+		}
+		nodes += step.To - step.From
+		if nodes <= 0 {
+			return fmt.Errorf("refusing to %s, the cluster would be left without nodes", step)
+		}
+	}
+	return nil
+}
+
+// pending returns the steps that are not done yet.
+func (p *updatePlan) pending() []planStep {
+	var steps []planStep
+	for _, step := range p.Steps {
+		if !step.Done {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// planApplier applies the steps of a plan, recording the resulting node
+// pools in the state.
+type planApplier struct {
+	client    *raw.Client
+	clientset kubernetes.Interface
+	clusterID int
+	state     *state
+	timeouts  waitTimeouts
+}
+
+func (a *planApplier) apply(ctx context.Context, plan *updatePlan) error {
+	for i := range plan.Steps {
+		step := &plan.Steps[i]
+		if step.Done {
+			continue
+		}
+
+		reportProgress(ctx, a.clusterID, "%s", step)
+		step.Started = true
+		if err := a.applyStep(ctx, step); err != nil {
+			return fmt.Errorf("failed to %s: %w", step, err)
+		}
+		reportProgress(ctx, a.clusterID, "done: %s", step)
+
+		step.Done = true
+		a.record(*step)
+	}
+	return nil
+}
+
+// applyStep applies a single step and waits for the pool to converge. Steps
+// check the live pool first, so that they only do what is left to do.
+func (a *planApplier) applyStep(ctx context.Context, step *planStep) error {
+	switch step.Action {
+	case actionCreatePool:
+		pools, err := a.client.ListLKENodePools(ctx, a.clusterID, nil)
+		if err != nil {
+			return err
+		}
+		for _, pool := range pools {
+			if pool.Type == step.Type {
+				step.PoolID = pool.ID
+				return nil
+			}
+		}
+		pool, err := a.client.CreateLKENodePool(ctx, a.clusterID, raw.LKENodePoolCreateOptions{
+			Count: step.To,
+			Type:  step.Type,
+		})
+		if err != nil {
+			return err
+		}
+		step.PoolID = pool.ID
+	case actionResizePool:
+		pool, err := a.client.GetLKENodePool(ctx, a.clusterID, step.PoolID)
+		if err != nil {
+			return err
+		}
+		if pool.Count > step.To {
+			err = removePoolNodes(ctx, a.client, a.clientset, a.clusterID, *pool, pool.Count-step.To, a.timeouts)
+		} else if pool.Count < step.To {
+			_, err = a.client.UpdateLKENodePool(ctx, a.clusterID, step.PoolID, raw.LKENodePoolUpdateOptions{
+				Count: step.To,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	case actionDeletePool:
+		pool, err := a.client.GetLKENodePool(ctx, a.clusterID, step.PoolID)
+		if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := drainPool(ctx, a.client, a.clientset, a.clusterID, *pool, a.timeouts); err != nil {
+			return err
+		}
+		if err := a.client.DeleteLKENodePool(ctx, a.clusterID, step.PoolID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown plan action %q", step.Action)
+	}
+
+	count := step.To
+	if step.Action == actionDeletePool {
+		count = 0
+	}
+	return waitUntilPoolConverged(ctx, a.client, a.clientset, a.clusterID, step.PoolID, count, a.timeouts.PoolReady)
+}
+
+// rollback reverts the steps of the plan that were applied in reverse order,
+// including the step that failed part way. Undoing a step checks the live
+// pool, so whatever part of the failed step ran is undone.
+func (a *planApplier) rollback(ctx context.Context, plan *updatePlan) error {
+	for i := len(plan.Steps) - 1; i >= 0; i-- {
+		step := plan.Steps[i]
+		if !step.Started {
+			continue
+		}
+		if step.Action == actionCreatePool && step.PoolID == 0 {
+			// The pool may have been created even though the request failed
+			poolID, err := a.poolOfType(ctx, step.Type)
+			if err != nil {
+				return fmt.Errorf("failed to roll back, %s: %w", step, err)
+			}
+			if poolID == 0 {
+				plan.Steps[i].Started = false
+				continue
+			}
+			step.PoolID = poolID
+		}
+
+		undo := planStep{Type: step.Type, PoolID: step.PoolID, From: step.To, To: step.From}
+		switch step.Action {
+		case actionCreatePool:
+			undo.Action = actionDeletePool
+		case actionResizePool:
+			undo.Action = actionResizePool
+		case actionDeletePool:
+			undo.Action = actionCreatePool
+		}
+
+		reportProgress(ctx, a.clusterID, "rolling back, %s", undo)
+		if err := a.applyStep(ctx, &undo); err != nil {
+			return fmt.Errorf("failed to roll back, %s: %w", undo, err)
+		}
+
+		plan.Steps[i].Done = false
+		plan.Steps[i].Started = false
+		a.record(undo)
+	}
+	return nil
+}
+
+// poolOfType returns the ID of the live pool of the node type, or 0 if there
+// is none.
+func (a *planApplier) poolOfType(ctx context.Context, nodeType string) (int, error) {
+	pools, err := a.client.ListLKENodePools(ctx, a.clusterID, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, pool := range pools {
+		if pool.Type == nodeType {
+			return pool.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// record updates the node pools of the state after a step.
+func (a *planApplier) record(step planStep) {
+	if a.state.NodePools == nil {
+		a.state.NodePools = map[string]int{}
+	}
+	if step.Action == actionDeletePool {
+		delete(a.state.NodePools, step.Type)
+		return
+	}
+	a.state.NodePools[step.Type] = step.To
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputePoolPlan(t *testing.T) {
+	pools := []raw.LKENodePool{
+		{ID: 2, Type: "g6-standard-2", Count: 3},
+		{ID: 1, Type: "g6-standard-1", Count: 2},
+		{ID: 3, Type: "g6-standard-4", Count: 1},
+	}
+	target := map[string]int{
+		"g6-standard-1": 2,
+		"g6-standard-2": 5,
+		"g6-standard-8": 1,
+	}
+
+	plan := computePoolPlan(pools, target)
+
+	assert.Equal(t, []planStep{
+		{Action: actionCreatePool, Type: "g6-standard-8", To: 1},
+		{Action: actionResizePool, Type: "g6-standard-2", PoolID: 2, From: 3, To: 5},
+		{Action: actionDeletePool, Type: "g6-standard-4", PoolID: 3, From: 1},
+	}, plan.Steps)
+	assert.NoError(t, plan.validate(pools))
+}
+
+func TestComputePoolPlan_ReplacePool(t *testing.T) {
+	pools := []raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-2", Count: 3},
+	}
+
+	plan := computePoolPlan(pools, map[string]int{"g6-standard-4": 3})
+
+	assert.Equal(t, []planStep{
+		{Action: actionCreatePool, Type: "g6-standard-4", To: 3},
+		{Action: actionDeletePool, Type: "g6-standard-2", PoolID: 1, From: 3},
+	}, plan.Steps)
+	assert.NoError(t, plan.validate(pools))
+}
+
+func TestUpdatePlan_ValidateRefusesEmptyCluster(t *testing.T) {
+	pools := []raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-2", Count: 3},
+	}
+	plan := &updatePlan{
+		Steps: []planStep{
+			{Action: actionDeletePool, Type: "g6-standard-2", PoolID: 1, From: 3},
+			{Action: actionCreatePool, Type: "g6-standard-4", To: 3},
+		},
+	}
+
+	assert.Error(t, plan.validate(pools))
+}
+
+func TestComputeClusterUpdate(t *testing.T) {
+	ha := true
+	cluster := &raw.LKECluster{
+		Label: "old",
+		Tags:  []string{"a", "b"},
+	}
+
+	updateOpts, changes := computeClusterUpdate(cluster, state{
+		Label:            "new",
+		Tags:             []string{"b", "a"},
+		HighAvailability: &ha,
+	})
+
+	assert.Equal(t, "new", updateOpts.Label)
+	assert.Nil(t, updateOpts.Tags)
+	assert.True(t, updateOpts.ControlPlane.HighAvailability)
+	assert.Equal(t, []clusterChange{
+		{Field: "label", From: "old", To: "new"},
+		{Field: "high-availability", From: "false", To: "true"},
+	}, changes)
+
+	_, changes = computeClusterUpdate(cluster, state{Tags: []string{"a", "b"}})
+	assert.Empty(t, changes, "empty label and nil HA are left alone")
+	assert.Equal(t, "no changes", dryRunPlan{Cluster: changes}.String())
+}
+
+// fakeLinodeAPI serves the node pools of LKE cluster 1. The nodes of pools of
+// the notReady node type never become ready.
+type fakeLinodeAPI struct {
+	lock     sync.Mutex
+	pools    map[int]*raw.LKENodePool
+	nextID   int
+	notReady string
+}
+
+var fakePoolPath = regexp.MustCompile(`^/v4/lke/clusters/1/(pools|nodes)(?:/([^/]+))?$`)
+
+func newFakeLinodeAPI(t *testing.T, pools ...raw.LKENodePool) (*fakeLinodeAPI, *raw.Client) {
+	api := &fakeLinodeAPI{pools: map[int]*raw.LKENodePool{}, nextID: 100}
+	for i := range pools {
+		api.pools[pools[i].ID] = &pools[i]
+	}
+
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	client := raw.NewClient(server.Client())
+	client.SetBaseURL(server.URL)
+	client.SetRetryCount(0)
+	return api, &client
+}
+
+// resize adds or removes nodes until the pool has count nodes.
+func (f *fakeLinodeAPI) resize(pool *raw.LKENodePool, count int) {
+	status := raw.LKELinodeReady
+	if pool.Type == f.notReady {
+		status = raw.LKELinodeNotReady
+	}
+	for len(pool.Linodes) < count {
+		f.nextID++
+		pool.Linodes = append(pool.Linodes, raw.LKENodePoolLinode{
+			ID:         fmt.Sprintf("%d-%d", pool.ID, f.nextID),
+			InstanceID: f.nextID,
+			Status:     status,
+		})
+	}
+	pool.Linodes = pool.Linodes[:count]
+	pool.Count = count
+}
+
+func (f *fakeLinodeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	notFound := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[{"reason":"Not found"}]}`))
+	}
+
+	if r.URL.Path == "/v4/account/events" {
+		reply(map[string]interface{}{"data": []raw.Event{}, "page": 1, "pages": 1, "results": 0})
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, "/v4/linode/instances/"); id != r.URL.Path {
+		instanceID, _ := strconv.Atoi(id)
+		reply(raw.Instance{ID: instanceID, Label: "node-" + id})
+		return
+	}
+
+	match := fakePoolPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		notFound()
+		return
+	}
+
+	if match[1] == "nodes" {
+		for _, pool := range f.pools {
+			for i, linode := range pool.Linodes {
+				if linode.ID == match[2] && r.Method == http.MethodDelete {
+					pool.Linodes = append(pool.Linodes[:i], pool.Linodes[i+1:]...)
+					pool.Count--
+					reply(map[string]interface{}{})
+					return
+				}
+			}
+		}
+		notFound()
+		return
+	}
+
+	if match[2] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			pools := []raw.LKENodePool{}
+			for _, pool := range f.pools {
+				pools = append(pools, *pool)
+			}
+			reply(map[string]interface{}{"data": pools, "page": 1, "pages": 1, "results": len(pools)})
+		case http.MethodPost:
+			var opts raw.LKENodePoolCreateOptions
+			_ = json.NewDecoder(r.Body).Decode(&opts)
+			f.nextID++
+			pool := &raw.LKENodePool{ID: f.nextID, Type: opts.Type}
+			f.resize(pool, opts.Count)
+			f.pools[pool.ID] = pool
+			reply(pool)
+		}
+		return
+	}
+
+	poolID, _ := strconv.Atoi(match[2])
+	pool, ok := f.pools[poolID]
+	if !ok {
+		notFound()
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		reply(pool)
+	case http.MethodPut:
+		var opts raw.LKENodePoolUpdateOptions
+		_ = json.NewDecoder(r.Body).Decode(&opts)
+		f.resize(pool, opts.Count)
+		reply(pool)
+	case http.MethodDelete:
+		delete(f.pools, poolID)
+		reply(map[string]interface{}{})
+	}
+}
+
+// counts returns the node count of every pool by node type.
+func (f *fakeLinodeAPI) counts() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	counts := map[string]int{}
+	for _, pool := range f.pools {
+		counts[pool.Type] = pool.Count
+	}
+	return counts
+}
+
+func testPlanApplier(client *raw.Client, nodePools map[string]int) *planApplier {
+	return &planApplier{
+		client:    client,
+		clusterID: 1,
+		state:     &state{NodePools: nodePools},
+		timeouts:  waitTimeouts{PoolReady: 200 * time.Millisecond},
+	}
+}
+
+func TestPlanApplier_Apply(t *testing.T) {
+	api, client := newFakeLinodeAPI(t,
+		raw.LKENodePool{ID: 1, Type: "g6-standard-2", Count: 2, Linodes: []raw.LKENodePoolLinode{
+			{ID: "1-a", InstanceID: 1, Status: raw.LKELinodeReady},
+			{ID: "1-b", InstanceID: 2, Status: raw.LKELinodeReady},
+		}},
+		raw.LKENodePool{ID: 2, Type: "g6-standard-4", Count: 1, Linodes: []raw.LKENodePoolLinode{
+			{ID: "2-a", InstanceID: 3, Status: raw.LKELinodeReady},
+		}},
+	)
+	target := map[string]int{"g6-standard-2": 1, "g6-standard-8": 2}
+	plan := computePoolPlan([]raw.LKENodePool{
+		{ID: 1, Type: "g6-standard-2", Count: 2},
+		{ID: 2, Type: "g6-standard-4", Count: 1},
+	}, target)
+	applier := testPlanApplier(client, map[string]int{"g6-standard-2": 2, "g6-standard-4": 1})
+
+	assert.NoError(t, applier.apply(context.Background(), plan))
+	assert.Equal(t, target, api.counts())
+	assert.Equal(t, target, applier.state.NodePools)
+}
+
+func TestPlanApplier_RollbackUndoesFailedCreate(t *testing.T) {
+	api, client := newFakeLinodeAPI(t, raw.LKENodePool{ID: 1, Type: "g6-standard-2", Count: 1, Linodes: []raw.LKENodePoolLinode{
+		{ID: "1-a", InstanceID: 1, Status: raw.LKELinodeReady},
+	}})
+	api.notReady = "g6-standard-8"
+	stored := map[string]int{"g6-standard-2": 1}
+	plan := computePoolPlan([]raw.LKENodePool{{ID: 1, Type: "g6-standard-2", Count: 1}},
+		map[string]int{"g6-standard-2": 1, "g6-standard-8": 1})
+	applier := testPlanApplier(client, map[string]int{"g6-standard-2": 1})
+
+	ctx := context.Background()
+	assert.Error(t, applier.apply(ctx, plan))
+	assert.NoError(t, applier.rollback(ctx, plan))
+	assert.Equal(t, stored, api.counts())
+	assert.Equal(t, stored, applier.state.NodePools)
+}
+
+func TestPlanApplier_RollbackUndoesFailedResize(t *testing.T) {
+	api, client := newFakeLinodeAPI(t, raw.LKENodePool{ID: 1, Type: "g6-standard-2", Count: 1, Linodes: []raw.LKENodePoolLinode{
+		{ID: "1-a", InstanceID: 1, Status: raw.LKELinodeReady},
+	}})
+	api.notReady = "g6-standard-2"
+	stored := map[string]int{"g6-standard-2": 1}
+	plan := computePoolPlan([]raw.LKENodePool{{ID: 1, Type: "g6-standard-2", Count: 1}},
+		map[string]int{"g6-standard-2": 3, "g6-standard-8": 1})
+	applier := testPlanApplier(client, map[string]int{"g6-standard-2": 1})
+
+	ctx := context.Background()
+	assert.Error(t, applier.apply(ctx, plan))
+	assert.True(t, plan.Steps[0].Done)
+	assert.NoError(t, applier.rollback(ctx, plan))
+	assert.Equal(t, stored, api.counts())
+	assert.Equal(t, stored, applier.state.NodePools)
+}
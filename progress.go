@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/rke/log"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// reportProgress sends a progress event of a long-running operation to the
+// logger of the request, which kontainer-engine streams to the Rancher UI.
+// Requests without a logger fall back to logrus.
+func reportProgress(ctx context.Context, clusterID int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Infof(ctx, "[lke] cluster %d: %s", clusterID, message)
+	addSpanEvent(ctx, message, attribute.Int("lke.cluster_id", clusterID))
+}
+
+// reportWarning is reportProgress for events that need attention.
+func reportWarning(ctx context.Context, clusterID int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Warnf(ctx, "[lke] cluster %d: %s", clusterID, message)
+	addSpanEvent(ctx, message, attribute.Int("lke.cluster_id", clusterID), attribute.Bool("warning", true))
+}
+
+// withNodeProgress wraps a cluster condition so that, while it does not hold,
+// the number of ready nodes of the cluster is reported whenever it changes.
+// The nodes are only looked up again after an event of the cluster.
+func withNodeProgress(
+	client *raw.Client,
+	clusterID int,
+	events *eventSubscription,
+	condition raw.ClusterConditionFunc,
+) raw.ClusterConditionFunc {
+	lastReady, lastTotal := -1, -1
+	return func(ctx context.Context, options raw.ClusterConditionOptions) (bool, error) {
+		waitIterations.WithLabelValues("cluster-ready-node").Inc()
+		done, err := condition(ctx, options)
+		if done {
+			return done, err
+		}
+
+		if lastTotal >= 0 {
+			select {
+			case <-events.C:
+			default:
+				return done, err
+			}
+		}
+
+		pools, listErr := client.ListLKENodePools(ctx, clusterID, nil)
+		if listErr != nil {
+			return done, err
+		}
+		ready, total := 0, 0
+		for i := range pools {
+			total += pools[i].Count
+			ready += len(pools[i].Linodes) - len(notReadyNodes(&pools[i]))
+		}
+		if ready != lastReady || total != lastTotal {
+			reportProgress(ctx, clusterID, "waiting for nodes, %d/%d ready", ready, total)
+			lastReady, lastTotal = ready, total
+		}
+		return done, err
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/rancher/rke/log"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// The manifest is the first file of a snapshot
+	snapshotManifestFile = "manifest.json"
+	// Resources are stored in the snapshot as
+	// resources/<group>/<version>/<resource>/<namespace>/<name>.json
+	snapshotResourcesDir = "resources"
+	coreGroupDir         = "core"
+	clusterScopedDir     = "_cluster"
+
+	// Restoring custom resources may have to wait for their definitions
+	restorePasses = 3
+)
+
+var (
+	// Resources that are not worth restoring, or that the cluster recreates
+	// on its own
+	excludedResources = map[string]bool{
+		"events":                          true,
+		"nodes":                           true,
+		"endpoints":                       true,
+		"endpointslices":                  true,
+		"leases":                          true,
+		"pods":                            true,
+		"replicasets":                     true,
+		"controllerrevisions":             true,
+		"componentstatuses":               true,
+		"certificatesigningrequests":      true,
+		"volumeattachments":               true,
+		"csinodes":                        true,
+		"apiservices":                     true,
+		"mutatingwebhookconfigurations":   true,
+		"validatingwebhookconfigurations": true,
+	}
+
+	// Namespaces managed by LKE
+	systemNamespaces = map[string]bool{
+		metav1.NamespaceSystem: true,
+		metav1.NamespacePublic: true,
+		"kube-node-lease":      true,
+	}
+
+	// Resources are restored in this order, followed by everything else, so
+	// that the resources they depend on exist first
+	restoreOrder = []string{
+		"customresourcedefinitions",
+		"namespaces",
+		"storageclasses",
+		"priorityclasses",
+		"clusterroles",
+		"clusterrolebindings",
+		"serviceaccounts",
+		"secrets",
+		"configmaps",
+		"roles",
+		"rolebindings",
+		"limitranges",
+		"resourcequotas",
+		"persistentvolumes",
+		"persistentvolumeclaims",
+		"services",
+		"deployments",
+		"statefulsets",
+		"daemonsets",
+		"jobs",
+		"cronjobs",
+		"ingressclasses",
+		"ingresses",
+	}
+)
+
+// snapshotManifest records the cluster a snapshot was taken of.
+type snapshotManifest struct {
+	ClusterID  int            `json:"clusterID"`
+	K8sVersion string         `json:"kubernetesVersion"`
+	NodePools  map[string]int `json:"nodePools"`
+	CreatedAt  time.Time      `json:"createdAt"`
+}
+
+// newSnapshotManifest describes the live cluster, since the state may lag
+// behind resizes and upgrades that could not store their result.
+func newSnapshotManifest(cluster *raw.LKECluster, pools []raw.LKENodePool) *snapshotManifest {
+	return &snapshotManifest{
+		ClusterID:  cluster.ID,
+		K8sVersion: cluster.K8sVersion,
+		NodePools:  livePoolCounts(pools),
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// checkRestorable fails if the snapshot was taken of another cluster, of
+// another Kubernetes version or of a cluster with other node types than the
+// live cluster, since its resources may not fit.
+func (m *snapshotManifest) checkRestorable(cluster *raw.LKECluster, pools []raw.LKENodePool) error {
+	if m.ClusterID != cluster.ID {
+		return fmt.Errorf("snapshot was taken of LKE cluster %d, not %d", m.ClusterID, cluster.ID)
+	}
+	if m.K8sVersion != cluster.K8sVersion {
+		return fmt.Errorf("snapshot was taken of Kubernetes %s, but the cluster runs %s", m.K8sVersion, cluster.K8sVersion)
+	}
+
+	livePools := livePoolCounts(pools)
+	var missing, added []string
+	for nodeType := range m.NodePools {
+		if _, ok := livePools[nodeType]; !ok {
+			missing = append(missing, nodeType)
+		}
+	}
+	for nodeType := range livePools {
+		if _, ok := m.NodePools[nodeType]; !ok {
+			added = append(added, nodeType)
+		}
+	}
+	if len(missing) > 0 || len(added) > 0 {
+		sort.Strings(missing)
+		sort.Strings(added)
+		return fmt.Errorf("snapshot was taken of a cluster with other node pools, missing [%s], added [%s]",
+			strings.Join(missing, ", "), strings.Join(added, ", "))
+	}
+	return nil
+}
+
+// snapshotResource is a resource read from a snapshot.
+type snapshotResource struct {
+	path      string
+	gvr       schema.GroupVersionResource
+	namespace string
+	object    *unstructured.Unstructured
+}
+
+// clusterRESTConfig returns the client configuration of the cluster from the
+// kubeconfig stored by PostCheck.
+func clusterRESTConfig(info *types.ClusterInfo) (*rest.Config, error) {
+	if !exists(info.Metadata, "KubeConfig") {
+		return nil, fmt.Errorf("the cluster has no kubeconfig yet")
+	}
+
+	kubeconfig, err := base64.StdEncoding.DecodeString(info.Metadata["KubeConfig"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode kubeconfig: %s", err)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %s", err)
+	}
+	return config, nil
+}
+
+// exportResources writes the manifest and every namespaced and cluster-scoped
+// resource the cluster would not recreate on its own into a gzipped tarball.
+func exportResources(ctx context.Context, config *rest.Config, manifest *snapshotManifest, w io.Writer) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery client: %s", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create dynamic client: %s", err)
+	}
+
+	resourceLists, err := discoveryClient.ServerPreferredResources()
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return fmt.Errorf("failed to discover API resources: %s", err)
+		}
+		// Aggregated APIs that are down should not prevent the backup
+		log.Warnf(ctx, "[lke] some API resources are not backed up: %s", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot manifest: %s", err)
+	}
+	if err := writeTarFile(archive, snapshotManifestFile, data); err != nil {
+		return err
+	}
+
+	exported := 0
+	for _, list := range resourceLists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			return fmt.Errorf("failed to parse group version %s: %s", list.GroupVersion, err)
+		}
+		for _, resource := range list.APIResources {
+			if !exportableResource(resource) {
+				continue
+			}
+
+			gvr := gv.WithResource(resource.Name)
+			objects, err := dynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to list %s: %s", gvr, err)
+			}
+			for i := range objects.Items {
+				object := &objects.Items[i]
+				if !exportableObject(object) {
+					continue
+				}
+				sanitizeObject(gvr, object)
+
+				data, err := json.Marshal(object.Object)
+				if err != nil {
+					return fmt.Errorf("failed to encode %s %s: %s", gvr, object.GetName(), err)
+				}
+				if err := writeTarFile(archive, resourcePath(gvr, object.GetNamespace(), object.GetName()), data); err != nil {
+					return err
+				}
+				exported++
+			}
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %s", err)
+	}
+	log.Infof(ctx, "[lke] exported %d resources", exported)
+	return nil
+}
+
+func exportableResource(resource metav1.APIResource) bool {
+	// Subresources like pods/log are part of their resource
+	if strings.Contains(resource.Name, "/") || excludedResources[resource.Name] {
+		return false
+	}
+
+	verbs := map[string]bool{}
+	for _, verb := range resource.Verbs {
+		verbs[verb] = true
+	}
+	return verbs["list"] && verbs["create"]
+}
+
+func exportableObject(object *unstructured.Unstructured) bool {
+	// Owned objects are recreated by their owners
+	if len(object.GetOwnerReferences()) > 0 {
+		return false
+	}
+	if systemNamespaces[object.GetNamespace()] {
+		return false
+	}
+
+	switch object.GetKind() {
+	case "Namespace":
+		return !systemNamespaces[object.GetName()]
+	case "Secret":
+		// Tokens are issued again for the restored service accounts
+		secretType, _, _ := unstructured.NestedString(object.Object, "type")
+		return secretType != "kubernetes.io/service-account-token"
+	}
+
+	// Cluster-scoped objects of Kubernetes itself, like system:* roles
+	return object.GetNamespace() != "" || !strings.HasPrefix(object.GetName(), "system:")
+}
+
+// sanitizeObject removes what the API server sets on its own, so that the
+// object can be created again in another cluster.
+func sanitizeObject(gvr schema.GroupVersionResource, object *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(object.Object, "status")
+	for _, field := range []string{"uid", "resourceVersion", "creationTimestamp", "generation", "managedFields", "selfLink"} {
+		unstructured.RemoveNestedField(object.Object, "metadata", field)
+	}
+
+	switch gvr.Resource {
+	case "services":
+		// Cluster IPs are allocated from the range of the new cluster
+		unstructured.RemoveNestedField(object.Object, "spec", "clusterIP")
+		unstructured.RemoveNestedField(object.Object, "spec", "clusterIPs")
+	case "persistentvolumes":
+		unstructured.RemoveNestedField(object.Object, "spec", "claimRef", "uid")
+		unstructured.RemoveNestedField(object.Object, "spec", "claimRef", "resourceVersion")
+	}
+}
+
+func resourcePath(gvr schema.GroupVersionResource, namespace string, name string) string {
+	group := gvr.Group
+	if group == "" {
+		group = coreGroupDir
+	}
+	if namespace == "" {
+		namespace = clusterScopedDir
+	}
+	return path.Join(snapshotResourcesDir, group, gvr.Version, gvr.Resource, namespace, name+".json")
+}
+
+// parseResourcePath is the inverse of resourcePath.
+func parseResourcePath(name string) (schema.GroupVersionResource, string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 || parts[0] != snapshotResourcesDir {
+		return schema.GroupVersionResource{}, "", false
+	}
+
+	gvr := schema.GroupVersionResource{Group: parts[1], Version: parts[2], Resource: parts[3]}
+	if gvr.Group == coreGroupDir {
+		gvr.Group = ""
+	}
+	namespace := parts[4]
+	if namespace == clusterScopedDir {
+		namespace = ""
+	}
+	return gvr, namespace, true
+}
+
+func writeTarFile(archive *tar.Writer, name string, data []byte) error {
+	err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err == nil {
+		_, err = archive.Write(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s to snapshot: %s", name, err)
+	}
+	return nil
+}
+
+// readSnapshot reads the manifest of a gzipped snapshot tarball, and its
+// resources in the order they are to be restored. The manifest is checked
+// before any resource is read.
+func readSnapshot(r io.Reader, check func(*snapshotManifest) error) ([]snapshotResource, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %s", err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	header, err := archive.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %s", err)
+	}
+	if header.Name != snapshotManifestFile {
+		return nil, fmt.Errorf("snapshot has no manifest")
+	}
+	manifest := &snapshotManifest{}
+	if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot manifest: %s", err)
+	}
+	if err := check(manifest); err != nil {
+		return nil, err
+	}
+
+	var resources []snapshotResource
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %s", err)
+		}
+
+		gvr, namespace, ok := parseResourcePath(header.Name)
+		if !ok {
+			continue
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from snapshot: %s", header.Name, err)
+		}
+		object := &unstructured.Unstructured{}
+		if err := json.Unmarshal(data, &object.Object); err != nil {
+			return nil, fmt.Errorf("failed to decode %s from snapshot: %s", header.Name, err)
+		}
+		resources = append(resources, snapshotResource{
+			path:      header.Name,
+			gvr:       gvr,
+			namespace: namespace,
+			object:    object,
+		})
+	}
+
+	sortForRestore(resources)
+	return resources, nil
+}
+
+// sortForRestore orders the resources by restoreOrder, and by path within
+// the same kind of resource.
+func sortForRestore(resources []snapshotResource) {
+	rank := func(resource string) int {
+		for i, name := range restoreOrder {
+			if name == resource {
+				return i
+			}
+		}
+		return len(restoreOrder)
+	}
+
+	sort.SliceStable(resources, func(i, j int) bool {
+		ri, rj := rank(resources[i].gvr.Resource), rank(resources[j].gvr.Resource)
+		if ri != rj {
+			return ri < rj
+		}
+		return resources[i].path < resources[j].path
+	})
+}
+
+// restoreResources creates the resources of the snapshot in the cluster.
+// Resources that exist already are left alone.
+func restoreResources(ctx context.Context, config *rest.Config, resources []snapshotResource) error {
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create dynamic client: %s", err)
+	}
+
+	var failed []string
+	pending := resources
+	for pass := 1; len(pending) > 0; pass++ {
+		var retry []snapshotResource
+		for _, resource := range pending {
+			_, err := dynamicClient.Resource(resource.gvr).Namespace(resource.namespace).
+				Create(ctx, resource.object, metav1.CreateOptions{})
+			switch {
+			case err == nil:
+			case errors.IsAlreadyExists(err):
+				logrus.Debugf("%s exists already, not restoring it", resource.path)
+			case (errors.IsNotFound(err) || meta.IsNoMatchError(err)) && pass < restorePasses:
+				// The definition of a custom resource may not be served yet
+				retry = append(retry, resource)
+			default:
+				failed = append(failed, fmt.Sprintf("%s: %s", resource.path, err))
+			}
+		}
+
+		if len(retry) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryInterval):
+			}
+		}
+		pending = retry
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to restore %d of %d resources: %s", len(failed), len(resources), strings.Join(failed, "; "))
+	}
+	log.Infof(ctx, "[lke] restored %d resources", len(resources))
+	return nil
+}
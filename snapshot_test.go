@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestResourcePath(t *testing.T) {
+	tests := []struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+		path      string
+	}{
+		{
+			gvr:       schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+			namespace: "default",
+			path:      "resources/core/v1/configmaps/default/settings.json",
+		},
+		{
+			gvr:  schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+			path: "resources/rbac.authorization.k8s.io/v1/clusterroles/_cluster/settings.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.path, resourcePath(tt.gvr, tt.namespace, "settings"))
+
+			gvr, namespace, ok := parseResourcePath(tt.path)
+			assert.True(t, ok)
+			assert.Equal(t, tt.gvr, gvr)
+			assert.Equal(t, tt.namespace, namespace)
+		})
+	}
+
+	_, _, ok := parseResourcePath("manifest.json")
+	assert.False(t, ok)
+}
+
+func TestSortForRestore(t *testing.T) {
+	resource := func(group string, name string) snapshotResource {
+		gvr := schema.GroupVersionResource{Group: group, Version: "v1", Resource: name}
+		return snapshotResource{gvr: gvr, path: resourcePath(gvr, "default", "a")}
+	}
+	resources := []snapshotResource{
+		resource("example.com", "widgets"),
+		resource("apps", "deployments"),
+		resource("", "namespaces"),
+		resource("apiextensions.k8s.io", "customresourcedefinitions"),
+		resource("", "configmaps"),
+	}
+
+	sortForRestore(resources)
+
+	var order []string
+	for _, r := range resources {
+		order = append(order, r.gvr.Resource)
+	}
+	assert.Equal(t, []string{"customresourcedefinitions", "namespaces", "configmaps", "deployments", "widgets"}, order)
+}
+
+func TestExportableObject(t *testing.T) {
+	object := func(kind string, namespace string, name string) *unstructured.Unstructured {
+		o := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		o.SetKind(kind)
+		o.SetNamespace(namespace)
+		o.SetName(name)
+		return o
+	}
+
+	owned := object("ConfigMap", "default", "owned")
+	owned.SetOwnerReferences([]metav1.OwnerReference{{Name: "owner"}})
+
+	token := object("Secret", "default", "token")
+	token.Object["type"] = "kubernetes.io/service-account-token"
+
+	assert.True(t, exportableObject(object("ConfigMap", "default", "settings")))
+	assert.True(t, exportableObject(object("Namespace", "", "apps")))
+	assert.True(t, exportableObject(object("Secret", "default", "password")))
+	assert.False(t, exportableObject(owned))
+	assert.False(t, exportableObject(token))
+	assert.False(t, exportableObject(object("ConfigMap", "kube-system", "coredns")))
+	assert.False(t, exportableObject(object("Namespace", "", "kube-system")))
+	assert.False(t, exportableObject(object("ClusterRole", "", "system:basic-user")))
+}
+
+func TestSnapshotManifestCheckRestorable(t *testing.T) {
+	cluster := &raw.LKECluster{ID: 12, K8sVersion: "1.27"}
+	pools := []raw.LKENodePool{{ID: 1, Type: "g6-standard-2", Count: 3}}
+	manifest := newSnapshotManifest(cluster, pools)
+	assert.Equal(t, map[string]int{"g6-standard-2": 3}, manifest.NodePools)
+
+	assert.NoError(t, manifest.checkRestorable(cluster, pools))
+	assert.NoError(t, manifest.checkRestorable(cluster, []raw.LKENodePool{{ID: 1, Type: "g6-standard-2", Count: 5}}))
+	assert.Error(t, manifest.checkRestorable(&raw.LKECluster{ID: 13, K8sVersion: "1.27"}, pools))
+	assert.Error(t, manifest.checkRestorable(&raw.LKECluster{ID: 12, K8sVersion: "1.28"}, pools))
+	assert.Error(t, manifest.checkRestorable(cluster, []raw.LKENodePool{{ID: 1, Type: "g6-standard-4", Count: 3}}))
+}
+
+func TestReadSnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	assert.NoError(t, writeTarFile(archive, snapshotManifestFile, []byte(`{"clusterID":12}`)))
+	assert.NoError(t, writeTarFile(archive, "resources/apps/v1/deployments/default/web.json", []byte(`{"kind":"Deployment"}`)))
+	assert.NoError(t, writeTarFile(archive, "resources/core/v1/namespaces/_cluster/apps.json", []byte(`{"kind":"Namespace"}`)))
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+
+	resources, err := readSnapshot(bytes.NewReader(buf.Bytes()), func(manifest *snapshotManifest) error {
+		assert.Equal(t, 12, manifest.ClusterID)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, resources, 2) {
+		assert.Equal(t, "Namespace", resources[0].object.GetKind())
+		assert.Equal(t, "default", resources[1].namespace)
+	}
+
+	_, err = readSnapshot(bytes.NewReader(buf.Bytes()), func(*snapshotManifest) error {
+		return errors.New("mismatch")
+	})
+	assert.EqualError(t, err, "mismatch")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+)
+
+const poolMetadataPrefix = "pool."
+
+// refreshClusterStatus fetches the cluster and its node pools and records
+// their status in the cluster info.
+func refreshClusterStatus(
+	ctx context.Context,
+	client *raw.Client,
+	clusterID int,
+	info *types.ClusterInfo,
+) (*raw.LKECluster, []raw.LKENodePool, error) {
+	cluster, pools, err := fetchCluster(ctx, client, clusterID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recordClusterStatus(info, cluster, pools)
+	return cluster, pools, nil
+}
+
+// fetchCluster fetches the cluster and its node pools.
+func fetchCluster(ctx context.Context, client *raw.Client, clusterID int) (*raw.LKECluster, []raw.LKENodePool, error) {
+	cluster, err := client.GetLKECluster(ctx, clusterID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get LKE cluster %d: %s", clusterID, err)
+	}
+	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	}
+	return cluster, pools, nil
+}
+
+// recordClusterStatus sets the status of the cluster info and records the
+// readiness of every node pool in the metadata:
+//
+//	pool.<id>.type   the node type of the pool
+//	pool.<id>.count  the number of nodes the pool should have
+//	pool.<id>.ready  the number of ready nodes of the pool
+//	pool.<id>.nodes  the status of every node, as <node id>=<status>
+func recordClusterStatus(info *types.ClusterInfo, cluster *raw.LKECluster, pools []raw.LKENodePool) {
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+
+	// Forget about pools that no longer exist
+	for key := range info.Metadata {
+		if strings.HasPrefix(key, poolMetadataPrefix) {
+			delete(info.Metadata, key)
+		}
+	}
+
+	info.Status = string(cluster.Status)
+
+	for _, pool := range pools {
+		prefix := fmt.Sprintf("%s%d.", poolMetadataPrefix, pool.ID)
+
+		nodes := make([]string, 0, len(pool.Linodes))
+		ready := 0
+		for _, linode := range pool.Linodes {
+			if linode.Status == raw.LKELinodeReady {
+				ready++
+			}
+			nodes = append(nodes, fmt.Sprintf("%s=%s", linode.ID, linode.Status))
+		}
+		sort.Strings(nodes)
+
+		info.Metadata[prefix+"type"] = pool.Type
+		info.Metadata[prefix+"count"] = strconv.Itoa(pool.Count)
+		info.Metadata[prefix+"ready"] = strconv.Itoa(ready)
+		info.Metadata[prefix+"nodes"] = strings.Join(nodes, ",")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordClusterStatus(t *testing.T) {
+	info := &types.ClusterInfo{Metadata: map[string]string{
+		"cluster-id":   "1",
+		"pool.9.ready": "3",
+	}}
+	cluster := &raw.LKECluster{ID: 1, Status: raw.LKEClusterReady}
+	pools := []raw.LKENodePool{{
+		ID:    2,
+		Type:  "g6-standard-1",
+		Count: 3,
+		Linodes: []raw.LKENodePoolLinode{
+			{ID: "2-b", Status: raw.LKELinodeNotReady},
+			{ID: "2-a", Status: raw.LKELinodeReady},
+		},
+	}}
+
+	recordClusterStatus(info, cluster, pools)
+
+	assert.Equal(t, "ready", info.Status)
+	assert.Equal(t, map[string]string{
+		"cluster-id":   "1",
+		"pool.2.type":  "g6-standard-1",
+		"pool.2.count": "3",
+		"pool.2.ready": "1",
+		"pool.2.nodes": "2-a=ready,2-b=not_ready",
+	}, info.Metadata)
+}
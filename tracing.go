@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is configured through the environment:
+//
+//	LKE_DRIVER_TRACING        the exporter, otlp or stdout, tracing is off if unset
+//	LKE_DRIVER_OTLP_ENDPOINT  the host:port of the OTLP collector, the standard
+//	                          OTEL_EXPORTER_OTLP_* variables apply if unset
+const (
+	tracingExporterEnv = "LKE_DRIVER_TRACING"
+	otlpEndpointEnv    = "LKE_DRIVER_OTLP_ENDPOINT"
+
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+
+	tracerName = "github.com/linode/kontainer-engine-driver-lke"
+)
+
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing installs the tracer provider selected by the environment. The
+// returned function flushes and stops it.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch os.Getenv(tracingExporterEnv) {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case tracingExporterOTLP:
+		var opts []otlptracegrpc.Option
+		if endpoint := os.Getenv(otlpEndpointEnv); endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", os.Getenv(tracingExporterEnv))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %s", os.Getenv(tracingExporterEnv), err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("kontainer-engine-driver-lke"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// tracedTransport opens a child span for every request sent through next.
+func tracedTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next, otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+		return req.Method + " " + apiEndpoint(req.URL.Path)
+	}))
+}
+
+// endSpan records the outcome of the operation and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// addSpanEvent records an event of a long-running operation, such as a wait
+// loop making progress, on the span of ctx.
+func addSpanEvent(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(attrs...))
+}
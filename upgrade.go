@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Upgrade strategies control how nodes are moved onto a new Kubernetes
+// version once the LKE control plane has been upgraded.
+const (
+	// upgradeStrategyNone leaves existing nodes untouched
+	upgradeStrategyNone = "none"
+	// upgradeStrategyPool recycles one pool at a time
+	upgradeStrategyPool = "rolling-pool"
+	// upgradeStrategyNode surges each pool and replaces its nodes in batches
+	upgradeStrategyNode = "rolling-node"
+)
+
+func addUpgradeFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["upgrade-strategy"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "How nodes are recycled after a Kubernetes upgrade: rolling-node, rolling-pool or none",
+		Default: &types.Default{
+			DefaultString: upgradeStrategyNode,
+		},
+	}
+	driverFlag.Options["upgrade-max-surge"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "The number of extra nodes added to a pool at once during a rolling-node upgrade",
+		Default: &types.Default{
+			DefaultInt: 1,
+		},
+	}
+}
+
+// upgradeCluster upgrades the control plane of the cluster to the given
+// version and recycles the worker nodes according to the upgrade strategy.
+// When the control plane already runs the version, as after an interrupted
+// upgrade, only the pools with nodes still on another version are recycled.
+func upgradeCluster(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	state state,
+	version string,
+) error {
+	cluster, err := client.GetLKECluster(ctx, clusterID)
+	if err != nil {
+		return fmt.Errorf("failed to get LKE cluster %d: %s", clusterID, err)
+	}
+
+	upgraded := cluster.K8sVersion != version
+	if upgraded {
+		reportProgress(ctx, clusterID, "upgrading from %s to %s", cluster.K8sVersion, version)
+
+		_, err = client.UpdateLKECluster(ctx, clusterID, raw.LKEClusterUpdateOptions{
+			K8sVersion: version,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade LKE cluster %d to %s: %s", clusterID, version, err)
+		}
+	}
+
+	pools, err := client.ListLKENodePools(ctx, clusterID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get pools for LKE cluster %d: %s", clusterID, err)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+
+	strategy := state.UpgradeStrategy
+	if strategy == "" {
+		strategy = upgradeStrategyNode
+	}
+	maxSurge := state.UpgradeMaxSurge
+	if maxSurge < 1 {
+		maxSurge = 1
+	}
+	timeouts := state.timeouts()
+
+	if strategy == upgradeStrategyNone {
+		reportProgress(ctx, clusterID, "skipping node recycle")
+		return nil
+	}
+
+	outdated := map[int]bool{}
+	if !upgraded {
+		if clientset == nil {
+			reportProgress(ctx, clusterID, "already on %s", version)
+			return nil
+		}
+		if outdated, err = outdatedPools(ctx, clientset, version); err != nil {
+			return err
+		}
+	}
+
+	for _, pool := range pools {
+		if !upgraded && !outdated[pool.ID] {
+			continue
+		}
+		switch strategy {
+		case upgradeStrategyPool:
+			err = recyclePool(ctx, client, clusterID, pool, timeouts)
+		case upgradeStrategyNode:
+			err = recyclePoolNodes(ctx, client, clientset, clusterID, pool, maxSurge, timeouts)
+		default:
+			return fmt.Errorf("unknown upgrade strategy %q", strategy)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	reportProgress(ctx, clusterID, "upgraded to %s", version)
+
+	return nil
+}
+
+// outdatedPools returns the IDs of the pools with a node whose kubelet does
+// not run the version.
+func outdatedPools(ctx context.Context, clientset kubernetes.Interface, version string) (map[int]bool, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: lkePoolLabel})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Kubernetes nodes: %s", err)
+	}
+
+	outdated := map[int]bool{}
+	for _, node := range nodes.Items {
+		if kubeletOnVersion(node.Status.NodeInfo.KubeletVersion, version) {
+			continue
+		}
+		poolID, err := strconv.Atoi(node.Labels[lkePoolLabel])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pool id of node %s: %s", node.Name, err)
+		}
+		outdated[poolID] = true
+	}
+	return outdated, nil
+}
+
+// kubeletOnVersion reports whether the kubelet version, e.g. v1.23.6, is a
+// release of the LKE version, e.g. 1.23.
+func kubeletOnVersion(kubeletVersion string, version string) bool {
+	kubeletVersion = strings.TrimPrefix(kubeletVersion, "v")
+	return kubeletVersion == version || strings.HasPrefix(kubeletVersion, version+".")
+}
+
+// recyclePool recycles every node of the pool through the LKE API and waits
+// until all of the original nodes have been replaced by ready ones.
+func recyclePool(ctx context.Context, client *raw.Client, clusterID int, pool raw.LKENodePool, timeouts waitTimeouts) error {
+	reportProgress(ctx, clusterID, "recycling pool %d", pool.ID)
+
+	// linodego does not wrap the pool recycle endpoint yet
+	resp, err := client.R(ctx).Post(fmt.Sprintf("lke/clusters/%d/pools/%d/recycle", clusterID, pool.ID))
+	if err == nil && resp.IsError() {
+		err = raw.NewError(resp)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to recycle LKE cluster %d node pool %d: %s", clusterID, pool.ID, err)
+	}
+
+	return waitUntilPoolNodesReplaced(ctx, client, clusterID, pool.ID, poolNodeIDs(pool), timeouts.PoolReady)
+}
+
+// recyclePoolNodes replaces the nodes of the pool in batches of maxSurge. Each
+// batch first grows the pool so that capacity never drops below the original
+// count, then drains and deletes the same number of old nodes.
+func recyclePoolNodes(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	pool raw.LKENodePool,
+	maxSurge int,
+	timeouts waitTimeouts,
+) error {
+	names, err := poolNodeNames(ctx, client, pool)
+	if err != nil {
+		return err
+	}
+	oldNodes := poolNodeIDs(pool).List()
+
+	for len(oldNodes) > 0 {
+		batch := oldNodes
+		if len(batch) > maxSurge {
+			batch = batch[:maxSurge]
+		}
+		oldNodes = oldNodes[len(batch):]
+
+		reportProgress(ctx, clusterID, "recycling nodes %v of pool %d", batch, pool.ID)
+
+		_, err := client.UpdateLKENodePool(ctx, clusterID, pool.ID, raw.LKENodePoolUpdateOptions{
+			Count: pool.Count + len(batch),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to surge LKE cluster %d node pool %d: %s", clusterID, pool.ID, err)
+		}
+
+		err = waitUntilPoolConverged(ctx, client, clientset, clusterID, pool.ID, pool.Count+len(batch), timeouts.PoolReady)
+		if err != nil {
+			return err
+		}
+
+		// Deleting a node also shrinks the pool back to its original count
+		if err := deletePoolNodes(ctx, client, clientset, clusterID, pool.ID, batch, names, timeouts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func poolNodeIDs(pool raw.LKENodePool) sets.String {
+	ids := sets.NewString()
+	for _, linode := range pool.Linodes {
+		ids.Insert(linode.ID)
+	}
+	return ids
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubeletOnVersion(t *testing.T) {
+	assert.True(t, kubeletOnVersion("v1.23.6", "1.23"))
+	assert.True(t, kubeletOnVersion("v1.23", "1.23"))
+	assert.False(t, kubeletOnVersion("v1.22.9", "1.23"))
+	assert.False(t, kubeletOnVersion("v1.230.1", "1.23"))
+}
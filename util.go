@@ -26,8 +26,8 @@ const (
 	serviceAccountSecretName  = "kontainer-engine-secret"
 )
 
-func generateServiceAccountToken(clientset kubernetes.Interface) (string, error) {
-	_, err := clientset.CoreV1().Namespaces().Create(context.TODO(), &v1.Namespace{
+func generateServiceAccountToken(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	_, err := clientset.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: cattleNamespace,
 		},
@@ -42,7 +42,7 @@ func generateServiceAccountToken(clientset kubernetes.Interface) (string, error)
 		},
 	}
 
-	_, err = clientset.CoreV1().ServiceAccounts(cattleNamespace).Create(context.TODO(), serviceAccount, metav1.CreateOptions{})
+	_, err = clientset.CoreV1().ServiceAccounts(cattleNamespace).Create(ctx, serviceAccount, metav1.CreateOptions{})
 	if err != nil && !errors.IsAlreadyExists(err) {
 		return "", fmt.Errorf("error creating service account: %v", err)
 	}
@@ -63,9 +63,9 @@ func generateServiceAccountToken(clientset kubernetes.Interface) (string, error)
 			},
 		},
 	}
-	clusterAdminRole, err := clientset.RbacV1().ClusterRoles().Get(context.TODO(), clusterAdmin, metav1.GetOptions{})
+	clusterAdminRole, err := clientset.RbacV1().ClusterRoles().Get(ctx, clusterAdmin, metav1.GetOptions{})
 	if err != nil {
-		clusterAdminRole, err = clientset.RbacV1().ClusterRoles().Create(context.TODO(), adminRole, metav1.CreateOptions{})
+		clusterAdminRole, err = clientset.RbacV1().ClusterRoles().Create(ctx, adminRole, metav1.CreateOptions{})
 		if err != nil {
 			return "", fmt.Errorf("error creating admin role: %v", err)
 		}
@@ -89,7 +89,7 @@ func generateServiceAccountToken(clientset kubernetes.Interface) (string, error)
 			APIGroup: rbacv1.GroupName,
 		},
 	}
-	if _, err = clientset.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBinding, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+	if _, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, clusterRoleBinding, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
 		return "", fmt.Errorf("error creating role bindings: %v", err)
 	}
 
@@ -105,7 +105,7 @@ func generateServiceAccountToken(clientset kubernetes.Interface) (string, error)
 	}
 
 	_, err = clientset.CoreV1().Secrets(cattleNamespace).Create(
-		context.TODO(),
+		ctx,
 		&secret,
 		metav1.CreateOptions{},
 	)
@@ -117,17 +117,20 @@ func generateServiceAccountToken(clientset kubernetes.Interface) (string, error)
 		)
 	}
 
-	return waitForServiceAccountSecretPopulated(clientset)
+	return waitForServiceAccountSecretPopulated(ctx, clientset)
 }
 
 // waitForServiceAccountSecretPopulated waits for the cattle service account
 // token to be populated.
-func waitForServiceAccountSecretPopulated(clientset kubernetes.Interface) (string, error) {
+func waitForServiceAccountSecretPopulated(ctx context.Context, clientset kubernetes.Interface) (string, error) {
 	var result string
 
-	err := wait.PollImmediate(time.Millisecond*500, time.Second*15, func() (done bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	err := wait.PollImmediateUntil(time.Millisecond*500, func() (done bool, err error) {
 		refreshedSecret, err := clientset.CoreV1().Secrets(cattleNamespace).Get(
-			context.TODO(),
+			ctx,
 			serviceAccountSecretName,
 			metav1.GetOptions{},
 		)
@@ -143,7 +146,7 @@ func waitForServiceAccountSecretPopulated(clientset kubernetes.Interface) (strin
 
 		result = string(token)
 		return true, nil
-	})
+	}, ctx.Done())
 
 	return result, err
 }
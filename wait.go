@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	raw "github.com/linode/linodego"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/rancher/rke/log"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// lkePoolLabel is set by LKE on every Kubernetes node of a pool
+const lkePoolLabel = "lke.linode.com/pool-id"
+
+const (
+	defaultCreateTimeout       = 20 * time.Minute
+	defaultPoolReadyTimeout    = 20 * time.Minute
+	defaultRemoveTimeout       = 10 * time.Minute
+	defaultDrainTimeout        = 10 * time.Minute
+	defaultControlPlaneTimeout = 30 * time.Minute
+	defaultHealthCheckTimeout  = 15 * time.Minute
+)
+
+func addTimeoutFlags(driverFlag *types.DriverFlags) {
+	driverFlag.Options["create-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for a new cluster to have a ready node",
+		Default: &types.Default{
+			DefaultInt: int64(defaultCreateTimeout / time.Second),
+		},
+	}
+	driverFlag.Options["pool-ready-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for a node pool to become ready after it changed",
+		Default: &types.Default{
+			DefaultInt: int64(defaultPoolReadyTimeout / time.Second),
+		},
+	}
+	driverFlag.Options["remove-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for a cluster to be deleted",
+		Default: &types.Default{
+			DefaultInt: int64(defaultRemoveTimeout / time.Second),
+		},
+	}
+	driverFlag.Options["drain-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for a node to be drained before it is removed",
+		Default: &types.Default{
+			DefaultInt: int64(defaultDrainTimeout / time.Second),
+		},
+	}
+	driverFlag.Options["control-plane-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for the control plane to convert after high availability changed",
+		Default: &types.Default{
+			DefaultInt: int64(defaultControlPlaneTimeout / time.Second),
+		},
+	}
+	driverFlag.Options["health-check-timeout"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Seconds to wait for the cluster to pass the health check",
+		Default: &types.Default{
+			DefaultInt: int64(defaultHealthCheckTimeout / time.Second),
+		},
+	}
+}
+
+// waitTimeouts bounds the waits of a driver operation
+type waitTimeouts struct {
+	Create       time.Duration
+	PoolReady    time.Duration
+	Remove       time.Duration
+	Drain        time.Duration
+	ControlPlane time.Duration
+	HealthCheck  time.Duration
+}
+
+// timeouts returns the configured wait timeouts, falling back to the defaults
+// for states stored before the timeouts were configurable.
+func (s *state) timeouts() waitTimeouts {
+	return waitTimeouts{
+		Create:       secondsOrDefault(s.CreateTimeout, defaultCreateTimeout),
+		PoolReady:    secondsOrDefault(s.PoolReadyTimeout, defaultPoolReadyTimeout),
+		Remove:       secondsOrDefault(s.RemoveTimeout, defaultRemoveTimeout),
+		Drain:        secondsOrDefault(s.DrainTimeout, defaultDrainTimeout),
+		ControlPlane: secondsOrDefault(s.ControlPlaneTimeout, defaultControlPlaneTimeout),
+		HealthCheck:  secondsOrDefault(s.HealthCheckTimeout, defaultHealthCheckTimeout),
+	}
+}
+
+func secondsOrDefault(seconds int, fallback time.Duration) time.Duration {
+	if seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// pollUntil calls condition every retryInterval until it is done, it fails,
+// the timeout expires or ctx is cancelled. condition reports why it is not
+// done yet. Changes of the reason are reported as progress, and the last
+// reason is included in the timeout error. kind names the condition in
+// metrics.
+func pollUntil(
+	ctx context.Context,
+	timeout time.Duration,
+	kind string,
+	what string,
+	condition func(ctx context.Context) (done bool, reason string, err error),
+) error {
+	return waitFor(ctx, timeout, kind, what, nil, condition)
+}
+
+// pollOnClusterEvents is pollUntil for conditions on the Linode side of a
+// cluster. Instead of polling, condition is checked again when an account
+// event concerns the cluster, and at least every eventFallbackInterval.
+func pollOnClusterEvents(
+	ctx context.Context,
+	client *raw.Client,
+	clusterID int,
+	timeout time.Duration,
+	kind string,
+	what string,
+	condition func(ctx context.Context) (done bool, reason string, err error),
+) error {
+	events := watchClusterEvents(client, clusterID)
+	defer events.Close()
+
+	return waitFor(ctx, timeout, kind, what, events, condition)
+}
+
+func waitFor(
+	ctx context.Context,
+	timeout time.Duration,
+	kind string,
+	what string,
+	events *eventSubscription,
+	condition func(ctx context.Context) (done bool, reason string, err error),
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	interval := retryInterval
+	var wake <-chan struct{}
+	if events != nil {
+		interval = eventFallbackInterval
+		wake = events.C
+	}
+
+	var reason string
+	iterations := 0
+	err := func() error {
+		for {
+			iterations++
+			waitIterations.WithLabelValues(kind).Inc()
+			done, why, err := condition(ctx)
+			if why != "" && why != reason {
+				log.Infof(ctx, "[lke] waiting for %s: %s", what, why)
+				addSpanEvent(ctx, "waiting for "+what,
+					attribute.String("lke.wait", kind),
+					attribute.String("lke.wait.reason", why),
+					attribute.Int("lke.wait.iteration", iterations))
+			}
+			reason = why
+			if err != nil || done {
+				return err
+			}
+
+			timer := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return wait.ErrWaitTimeout
+			case <-wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+	addSpanEvent(ctx, "finished waiting for "+what,
+		attribute.String("lke.wait", kind),
+		attribute.Int("lke.wait.iterations", iterations),
+		attribute.Bool("lke.wait.succeeded", err == nil))
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return fmt.Errorf("cancelled waiting for %s: %w", what, ctx.Err())
+		}
+		if reason == "" {
+			return fmt.Errorf("timed out after %s waiting for %s", timeout, what)
+		}
+		return fmt.Errorf("timed out after %s waiting for %s: %s", timeout, what, reason)
+	}
+	return err
+}
+
+// waitUntilPoolConverged waits until the pool has exactly count ready nodes,
+// both in the Linode API and, when a clientset is given, in Kubernetes. A
+// count of zero waits for a deleted pool and its nodes to disappear.
+func waitUntilPoolConverged(
+	ctx context.Context,
+	client *raw.Client,
+	clientset kubernetes.Interface,
+	clusterID int,
+	poolID int,
+	count int,
+	timeout time.Duration,
+) error {
+	deadline := time.Now().Add(timeout)
+	what := fmt.Sprintf("LKE cluster %d node pool %d to have %d ready nodes", clusterID, poolID, count)
+	err := pollOnClusterEvents(ctx, client, clusterID, timeout, "pool-converged", what, func(ctx context.Context) (bool, string, error) {
+		return linodePoolConverged(ctx, client, clusterID, poolID, count)
+	})
+	if err != nil || clientset == nil {
+		return err
+	}
+
+	// Kubernetes is polled, which does not count against the rate limits
+	// of the Linode API
+	return pollUntil(ctx, time.Until(deadline), "pool-converged-kubernetes", what, func(ctx context.Context) (bool, string, error) {
+		converged, reason := kubernetesPoolConverged(ctx, clientset, poolID, count)
+		return converged, reason, nil
+	})
+}
+
+func linodePoolConverged(ctx context.Context, client *raw.Client, clusterID int, poolID int, count int) (bool, string, error) {
+	pool, err := client.GetLKENodePool(ctx, clusterID, poolID)
+	if err != nil {
+		if le, ok := err.(*raw.Error); ok && le.Code == http.StatusNotFound && count == 0 {
+			return true, "", nil
+		}
+		return false, "", fmt.Errorf("failed to get LKE cluster %d node pool %d: %s", clusterID, poolID, err)
+	}
+	if pool.Count != count || len(pool.Linodes) != count {
+		return false, fmt.Sprintf("pool has %d of %d nodes", len(pool.Linodes), count), nil
+	}
+	if notReady := notReadyNodes(pool); len(notReady) > 0 {
+		return false, fmt.Sprintf("nodes %s are not ready", strings.Join(notReady, ", ")), nil
+	}
+	return true, "", nil
+}
+
+// kubernetesPoolConverged reports whether the pool has exactly count
+// Kubernetes nodes and all of them are Ready. Errors talking to the cluster
+// are treated as not converged yet.
+func kubernetesPoolConverged(ctx context.Context, clientset kubernetes.Interface, poolID int, count int) (bool, string) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%d", lkePoolLabel, poolID),
+	})
+	if err != nil {
+		logrus.Debugf("failed to list nodes of node pool %d: %s", poolID, err)
+		return false, fmt.Sprintf("failed to list Kubernetes nodes: %s", err)
+	}
+	if len(nodes.Items) != count {
+		return false, fmt.Sprintf("pool has %d of %d Kubernetes nodes", len(nodes.Items), count)
+	}
+	var notReady []string
+	for _, node := range nodes.Items {
+		if !nodeReady(node) {
+			notReady = append(notReady, node.Name)
+		}
+	}
+	if len(notReady) > 0 {
+		return false, fmt.Sprintf("Kubernetes nodes %s are not Ready", strings.Join(notReady, ", "))
+	}
+	return true, ""
+}
+
+func nodeReady(node v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func notReadyNodes(pool *raw.LKENodePool) []string {
+	var notReady []string
+	for _, linode := range pool.Linodes {
+		if linode.Status != raw.LKELinodeReady {
+			notReady = append(notReady, linode.ID)
+		}
+	}
+	return notReady
+}
+
+// waitUntilPoolNodesReplaced waits until none of the given nodes are part of
+// the pool anymore and every remaining node is ready.
+func waitUntilPoolNodesReplaced(
+	ctx context.Context,
+	client *raw.Client,
+	clusterID int,
+	poolID int,
+	nodeIDs sets.String,
+	timeout time.Duration,
+) error {
+	what := fmt.Sprintf("nodes %v of LKE cluster %d node pool %d to be replaced", nodeIDs.List(), clusterID, poolID)
+	return pollOnClusterEvents(ctx, client, clusterID, timeout, "pool-nodes-replaced", what, func(ctx context.Context) (bool, string, error) {
+		pool, err := client.GetLKENodePool(ctx, clusterID, poolID)
+		if err != nil {
+			return false, "", fmt.Errorf("failed to get LKE cluster %d node pool %d: %s", clusterID, poolID, err)
+		}
+		if len(pool.Linodes) != pool.Count {
+			return false, fmt.Sprintf("pool has %d of %d nodes", len(pool.Linodes), pool.Count), nil
+		}
+		remaining := poolNodeIDs(*pool).Intersection(nodeIDs)
+		if remaining.Len() > 0 {
+			return false, fmt.Sprintf("nodes %s are still part of the pool", strings.Join(remaining.List(), ", ")), nil
+		}
+		if notReady := notReadyNodes(pool); len(notReady) > 0 {
+			return false, fmt.Sprintf("nodes %s are not ready", strings.Join(notReady, ", ")), nil
+		}
+		return true, "", nil
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitFor_TimeoutNamesLastReason(t *testing.T) {
+	err := pollUntil(context.Background(), 50*time.Millisecond, "test", "node pool 7 to be ready", func(ctx context.Context) (bool, string, error) {
+		return false, "nodes 7-a are not ready", nil
+	})
+
+	assert.EqualError(t, err, "timed out after 50ms waiting for node pool 7 to be ready: nodes 7-a are not ready")
+}
+
+func TestWaitFor_TimeoutWithoutReason(t *testing.T) {
+	err := pollUntil(context.Background(), 50*time.Millisecond, "test", "node pool 7 to be ready", func(ctx context.Context) (bool, string, error) {
+		return false, "", nil
+	})
+
+	assert.EqualError(t, err, "timed out after 50ms waiting for node pool 7 to be ready")
+}
+
+func TestWaitFor_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := pollUntil(ctx, time.Minute, "test", "node pool 7 to be ready", func(ctx context.Context) (bool, string, error) {
+		cancel()
+		return false, "nodes 7-a are not ready", nil
+	})
+
+	assert.EqualError(t, err, "cancelled waiting for node pool 7 to be ready: context canceled")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestWaitFor_ConditionError(t *testing.T) {
+	conditionErr := errors.New("failed to get LKE cluster 12 node pool 7")
+	err := pollUntil(context.Background(), time.Minute, "test", "node pool 7 to be ready", func(ctx context.Context) (bool, string, error) {
+		return false, "", conditionErr
+	})
+
+	assert.Same(t, conditionErr, err)
+}